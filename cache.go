@@ -0,0 +1,517 @@
+package utils
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrLoaderPanic is returned to callers waiting on a GetOrLoad loader that
+// panicked.
+var ErrLoaderPanic = errors.New("cache: loader panicked")
+
+// EvictReason tells why an entry left the cache.
+type EvictReason int
+
+const (
+	// EvictExpired means the entry outlived its TTL.
+	EvictExpired EvictReason = iota + 1
+	// EvictCapacity means the entry was the least recently used one when
+	// the cache was full.
+	EvictCapacity
+	// EvictDeleted means the entry was removed explicitly.
+	EvictDeleted
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictExpired:
+		return "expired"
+	case EvictCapacity:
+		return "capacity"
+	case EvictDeleted:
+		return "deleted"
+	}
+	return "unknown"
+}
+
+// cacheConfig holds the optional settings of a cache.
+type cacheConfig struct {
+	ttl         time.Duration
+	capacity    int
+	janitor     time.Duration
+	stale       time.Duration
+	negativeTTL time.Duration
+	shards      int
+	prefixIndex bool
+	metrics     CacheMetrics
+	sizer       func(key, value interface{}) int64
+
+	codec            CacheCodec
+	snapshotPath     string
+	snapshotInterval time.Duration
+}
+
+// CacheOption configures a cache created by NewCache or NewCacheOf.
+type CacheOption func(*cacheConfig)
+
+// WithTTL sets the default TTL used by Set. d <= 0 means entries never
+// expire.
+func WithTTL(d time.Duration) CacheOption {
+	return func(c *cacheConfig) {
+		c.ttl = d
+	}
+}
+
+// WithCapacity limits the cache to n entries, evicting the least recently
+// used entry when a new key would exceed it. n <= 0 means unlimited.
+func WithCapacity(n int) CacheOption {
+	return func(c *cacheConfig) {
+		c.capacity = n
+	}
+}
+
+// WithJanitor starts a background goroutine that removes expired entries
+// every interval. The goroutine runs until Close is called.
+func WithJanitor(interval time.Duration) CacheOption {
+	return func(c *cacheConfig) {
+		c.janitor = interval
+	}
+}
+
+// WithStaleWhileRevalidate keeps entries for d after they expire. During
+// that window GetOrLoad serves the stale value and refreshes it with a
+// single background load; Get still reports a miss.
+func WithStaleWhileRevalidate(d time.Duration) CacheOption {
+	return func(c *cacheConfig) {
+		c.stale = d
+	}
+}
+
+// WithNegativeTTL makes GetOrLoad remember loader errors for d, returning
+// the same error without calling the loader again until it expires.
+// Remembered errors are bounded by WithCapacity like values, and expired
+// ones are dropped as new errors are cached.
+func WithNegativeTTL(d time.Duration) CacheOption {
+	return func(c *cacheConfig) {
+		c.negativeTTL = d
+	}
+}
+
+// WithShards splits the cache into n lock-striped shards selected by a hash
+// of the key. Each shard keeps its own LRU list and an equal part of the
+// capacity, so eviction is approximate LRU across the whole cache. Sharding
+// reduces lock contention for write-heavy workloads; n <= 1 uses a single
+// shard with exact LRU order.
+func WithShards(n int) CacheOption {
+	return func(c *cacheConfig) {
+		c.shards = n
+	}
+}
+
+// WithPrefixIndex indexes string keys in a radix tree so that DeletePrefix
+// only visits the matching keys instead of scanning the whole cache. The
+// index costs about one small node per key.
+func WithPrefixIndex() CacheOption {
+	return func(c *cacheConfig) {
+		c.prefixIndex = true
+	}
+}
+
+// Cache is a type-safe, concurrency-safe cache with per-key expiration and
+// an optional capacity limit enforced by LRU eviction. Each entry keeps its
+// value and metadata together, so they can never disagree.
+type Cache[K comparable, V any] struct {
+	shards []*cacheShard[K, V]
+	config cacheConfig
+
+	keyString func(K) string // nil when K is not a string type
+
+	onEvict  atomic.Pointer[func(key K, value V, reason EvictReason)]
+	counters cacheCounters
+
+	// calls holds the in-flight loads of GetOrLoad, guarded by loadMu.
+	loadMu sync.Mutex
+	calls  map[K]*loadCall[V]
+
+	stop      chan struct{}
+	closeOnce sync.Once
+	bg        sync.WaitGroup // background goroutines that must finish on Close
+}
+
+// cacheEntry is the element kept in the LRU list.
+type cacheEntry[K comparable, V any] struct {
+	key      K
+	value    V
+	expireAt time.Time // zero means never expire
+	size     int64     // approximate bytes, see sizeOf
+	tags     []string
+}
+
+func (e *cacheEntry[K, V]) expired(now time.Time) bool {
+	return !e.expireAt.IsZero() && !now.Before(e.expireAt)
+}
+
+// dead reports whether the entry is expired and past its stale window, so
+// it can no longer be served by GetOrLoad.
+func (e *cacheEntry[K, V]) dead(now time.Time, stale time.Duration) bool {
+	return !e.expireAt.IsZero() && !now.Before(e.expireAt.Add(stale))
+}
+
+// negativeEntry is a cached loader error.
+type negativeEntry struct {
+	err      error
+	expireAt time.Time
+}
+
+// loadCall is an in-flight or completed GetOrLoad loader call.
+type loadCall[V any] struct {
+	wg  sync.WaitGroup
+	val V
+	err error
+}
+
+// cacheEviction is an entry removed under the lock whose callback is still
+// to be run.
+type cacheEviction[K comparable, V any] struct {
+	entry  *cacheEntry[K, V]
+	reason EvictReason
+}
+
+// NewCacheOf creates a cache for keys of type K and values of type V.
+func NewCacheOf[K comparable, V any](opts ...CacheOption) *Cache[K, V] {
+	c := &Cache[K, V]{
+		keyString: stringKeyFunc[K](),
+		calls:     make(map[K]*loadCall[V]),
+		stop:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(&c.config)
+	}
+
+	n := c.config.shards
+	if n < 1 {
+		n = 1
+	}
+	capacity := 0
+	if c.config.capacity > 0 {
+		capacity = (c.config.capacity + n - 1) / n
+	}
+	var indexKey func(K) string
+	if c.config.prefixIndex {
+		indexKey = c.keyString
+	}
+	c.shards = make([]*cacheShard[K, V], n)
+	for i := range c.shards {
+		c.shards[i] = newCacheShard[K, V](capacity, indexKey)
+	}
+
+	if c.config.janitor > 0 {
+		c.bg.Add(1)
+		go c.janitor(c.config.janitor)
+	}
+	if fp := c.config.snapshotPath; fp != "" {
+		if IsExist(fp) {
+			if err := c.LoadFile(fp); err != nil {
+				log.Printf("cache: load snapshot %s: %v", fp, err)
+			}
+		}
+		c.bg.Add(1)
+		go c.snapshotter(c.config.snapshotInterval)
+	}
+	return c
+}
+
+// OnEvict registers fn to be called whenever an entry leaves the cache.
+// fn runs outside the cache lock, so it may call back into the cache.
+func (c *Cache[K, V]) OnEvict(fn func(key K, value V, reason EvictReason)) {
+	c.onEvict.Store(&fn)
+}
+
+// Close stops the background goroutines, if any, and writes the final
+// snapshot of WithSnapshotFile. The cache stays usable.
+func (c *Cache[K, V]) Close() {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+	})
+	c.bg.Wait()
+}
+
+func (c *Cache[K, V]) janitor(interval time.Duration) {
+	defer c.bg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.ClearExpired()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// shard returns the shard responsible for key.
+func (c *Cache[K, V]) shard(key K) *cacheShard[K, V] {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	return c.shards[hashKey(key)%uint64(len(c.shards))]
+}
+
+// Get returns the value stored under key. Expired entries are reported as
+// misses and removed once they are past the stale window.
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	var zero V
+
+	s := c.shard(key)
+	s.mu.Lock()
+	el, ok := s.items[key]
+	if !ok {
+		s.mu.Unlock()
+		c.miss()
+		return zero, false
+	}
+	e := el.Value.(*cacheEntry[K, V])
+	if now := time.Now(); e.expired(now) {
+		var evicted []cacheEviction[K, V]
+		if e.dead(now, c.config.stale) {
+			evicted = append(evicted, s.removeElement(el, EvictExpired))
+		}
+		s.mu.Unlock()
+		c.miss()
+		c.notify(evicted)
+		return zero, false
+	}
+	s.lru.MoveToFront(el)
+	s.mu.Unlock()
+	c.hit()
+	return e.value, true
+}
+
+// Set stores value under key with the default TTL of the cache.
+func (c *Cache[K, V]) Set(key K, value V) {
+	c.SetWithTTL(key, value, c.config.ttl)
+}
+
+// SetWithTTL stores value under key for ttl. ttl <= 0 means the entry
+// never expires.
+func (c *Cache[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	c.set(key, value, ttl, nil)
+}
+
+// SetWithTags stores value under key with the default TTL and attaches
+// tags to it, so it can be removed with InvalidateTag.
+func (c *Cache[K, V]) SetWithTags(key K, value V, tags ...string) {
+	c.set(key, value, c.config.ttl, tags)
+}
+
+func (c *Cache[K, V]) set(key K, value V, ttl time.Duration, tags []string) {
+	var expireAt time.Time
+	if ttl > 0 {
+		expireAt = time.Now().Add(ttl)
+	}
+
+	size := c.sizeOf(key, value)
+	s := c.shard(key)
+	s.mu.Lock()
+	evicted := s.set(key, value, expireAt, size, tags)
+	s.mu.Unlock()
+	c.notify(evicted)
+}
+
+// GetOrLoad returns the value stored under key, calling loader and storing
+// its result on a miss. Concurrent misses on the same key share a single
+// loader call. Loader errors are returned and, with WithNegativeTTL, cached.
+// With WithStaleWhileRevalidate an expired value is returned immediately
+// while one background load refreshes it.
+func (c *Cache[K, V]) GetOrLoad(key K, loader func() (V, error)) (V, error) {
+	now := time.Now()
+
+	s := c.shard(key)
+	s.mu.Lock()
+	if el, ok := s.items[key]; ok {
+		e := el.Value.(*cacheEntry[K, V])
+		if !e.expired(now) {
+			s.lru.MoveToFront(el)
+			s.mu.Unlock()
+			c.hit()
+			return e.value, nil
+		}
+		if !e.dead(now, c.config.stale) {
+			v := e.value
+			s.mu.Unlock()
+			c.hit()
+			c.refresh(key, loader)
+			return v, nil
+		}
+	}
+	if n, ok := s.negative[key]; ok {
+		if now.Before(n.expireAt) {
+			s.mu.Unlock()
+			c.miss()
+			var zero V
+			return zero, n.err
+		}
+		delete(s.negative, key)
+	}
+	s.mu.Unlock()
+	c.miss()
+
+	return c.load(key, loader)
+}
+
+// load runs loader for key unless a load is already in flight, in which
+// case it waits for that load and returns its result.
+func (c *Cache[K, V]) load(key K, loader func() (V, error)) (V, error) {
+	c.loadMu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.loadMu.Unlock()
+		call.wg.Wait()
+		return call.val, call.err
+	}
+	call := new(loadCall[V])
+	call.wg.Add(1)
+	c.calls[key] = call
+	c.loadMu.Unlock()
+
+	start := time.Now()
+	returned := false
+	defer func() {
+		if !returned {
+			call.err = ErrLoaderPanic
+			c.loaded(time.Since(start), call.err)
+		}
+		c.loadMu.Lock()
+		delete(c.calls, key)
+		c.loadMu.Unlock()
+		call.wg.Done()
+	}()
+
+	call.val, call.err = loader()
+	returned = true
+	c.loaded(time.Since(start), call.err)
+	if call.err == nil {
+		c.Set(key, call.val)
+	} else if c.config.negativeTTL > 0 {
+		s := c.shard(key)
+		s.mu.Lock()
+		now := time.Now()
+		s.setNegative(key, call.err, now, now.Add(c.config.negativeTTL))
+		s.mu.Unlock()
+	}
+	return call.val, call.err
+}
+
+// refresh starts a background load of key unless one is already running.
+func (c *Cache[K, V]) refresh(key K, loader func() (V, error)) {
+	c.loadMu.Lock()
+	_, running := c.calls[key]
+	c.loadMu.Unlock()
+	if !running {
+		go func() {
+			// A panic here would crash the process. load has already
+			// failed the waiters with ErrLoaderPanic; the stale value
+			// stays in place.
+			defer func() { _ = recover() }()
+			c.load(key, loader)
+		}()
+	}
+}
+
+// Delete removes key from the cache.
+func (c *Cache[K, V]) Delete(key K) {
+	s := c.shard(key)
+	s.mu.Lock()
+	delete(s.negative, key)
+	el, ok := s.items[key]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	ev := s.removeElement(el, EvictDeleted)
+	s.mu.Unlock()
+	c.notify([]cacheEviction[K, V]{ev})
+}
+
+// Len returns the number of entries, including expired entries that have
+// not been cleared yet.
+func (c *Cache[K, V]) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		n += s.lru.Len()
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Range calls fn for every unexpired entry until fn returns false. Entries
+// of a shard are visited from the most to the least recently used. fn sees
+// a snapshot taken before the first call and may modify the cache.
+func (c *Cache[K, V]) Range(fn func(key K, value V) bool) {
+	for _, e := range c.snapshot() {
+		if !fn(e.key, e.value) {
+			return
+		}
+	}
+}
+
+// Keys returns the keys of all unexpired entries in the order used by
+// Range.
+func (c *Cache[K, V]) Keys() []K {
+	entries := c.snapshot()
+	keys := make([]K, 0, len(entries))
+	for _, e := range entries {
+		keys = append(keys, e.key)
+	}
+	return keys
+}
+
+// ClearExpired removes all expired entries, keeping those still inside the
+// stale window of WithStaleWhileRevalidate.
+func (c *Cache[K, V]) ClearExpired() {
+	now := time.Now()
+	for _, s := range c.shards {
+		s.mu.Lock()
+		evicted := s.clearExpired(now, c.config.stale)
+		s.mu.Unlock()
+		c.notify(evicted)
+	}
+}
+
+// snapshot copies the unexpired entries of every shard.
+func (c *Cache[K, V]) snapshot() []cacheEntry[K, V] {
+	now := time.Now()
+	var entries []cacheEntry[K, V]
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for el := s.lru.Front(); el != nil; el = el.Next() {
+			if e := el.Value.(*cacheEntry[K, V]); !e.expired(now) {
+				entries = append(entries, *e)
+			}
+		}
+		s.mu.Unlock()
+	}
+	return entries
+}
+
+// notify counts evicted entries and reports them to the OnEvict callback. It must be called
+// without holding any shard lock.
+func (c *Cache[K, V]) notify(evicted []cacheEviction[K, V]) {
+	if len(evicted) == 0 {
+		return
+	}
+	for _, ev := range evicted {
+		c.evicted(ev.reason)
+	}
+	fn := c.onEvict.Load()
+	if fn == nil {
+		return
+	}
+	for _, ev := range evicted {
+		(*fn)(ev.entry.key, ev.entry.value, ev.reason)
+	}
+}
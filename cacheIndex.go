@@ -0,0 +1,248 @@
+package utils
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// InvalidateTag removes every entry stored with tag and returns how many
+// unexpired entries were removed. Removed entries are reported to OnEvict
+// as EvictDeleted.
+func (c *Cache[K, V]) InvalidateTag(tag string) int {
+	now := time.Now()
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		var evicted []cacheEviction[K, V]
+		for key := range s.tags[tag] {
+			evicted = append(evicted, s.removeElement(s.items[key], EvictDeleted))
+		}
+		s.mu.Unlock()
+		n += countLive(evicted, now)
+		c.notify(evicted)
+	}
+	return n
+}
+
+// DeletePrefix removes every entry whose key starts with prefix and returns
+// how many unexpired entries were removed. It only applies to caches with
+// string keys. It scans every key, in O(n) for n entries, unless the cache
+// was created WithPrefixIndex, as NewCache does; then its cost depends on
+// the number of matching keys rather than the size of the cache.
+func (c *Cache[K, V]) DeletePrefix(prefix string) int {
+	if c.keyString == nil {
+		return 0
+	}
+	now := time.Now()
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		var evicted []cacheEviction[K, V]
+		for _, key := range s.withPrefix(prefix, c.keyString) {
+			evicted = append(evicted, s.removeElement(s.items[key], EvictDeleted))
+		}
+		s.mu.Unlock()
+		n += countLive(evicted, now)
+		c.notify(evicted)
+	}
+	return n
+}
+
+// countLive returns the number of evicted entries that had not expired.
+func countLive[K comparable, V any](evicted []cacheEviction[K, V], now time.Time) int {
+	n := 0
+	for _, ev := range evicted {
+		if !ev.entry.expired(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// withPrefix returns the keys of s starting with prefix, from the index if
+// there is one. The caller must hold s.mu.
+func (s *cacheShard[K, V]) withPrefix(prefix string, keyString func(K) string) []K {
+	if s.prefixes != nil {
+		return s.prefixes.withPrefix(prefix)
+	}
+	var keys []K
+	for key := range s.items {
+		if strings.HasPrefix(keyString(key), prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// tag adds e to the tag index. The caller must hold s.mu.
+func (s *cacheShard[K, V]) tag(e *cacheEntry[K, V]) {
+	for _, t := range e.tags {
+		keys := s.tags[t]
+		if keys == nil {
+			keys = make(map[K]struct{})
+			s.tags[t] = keys
+		}
+		keys[e.key] = struct{}{}
+	}
+}
+
+// untag removes e from the tag index. The caller must hold s.mu.
+func (s *cacheShard[K, V]) untag(e *cacheEntry[K, V]) {
+	for _, t := range e.tags {
+		if keys := s.tags[t]; keys != nil {
+			delete(keys, e.key)
+			if len(keys) == 0 {
+				delete(s.tags, t)
+			}
+		}
+	}
+}
+
+// stringKeyFunc returns a function converting keys of type K to strings,
+// or nil if K is not a string type.
+func stringKeyFunc[K comparable]() func(K) string {
+	var zero K
+	if _, ok := any(zero).(string); ok {
+		return func(k K) string { return any(k).(string) }
+	}
+	if reflect.TypeOf(&zero).Elem().Kind() == reflect.String {
+		return func(k K) string { return reflect.ValueOf(k).String() }
+	}
+	return nil
+}
+
+// prefixTrie is a radix tree mapping key strings to keys. Each node holds
+// the run of bytes leading to it, so a key costs about one node however
+// long it is.
+type prefixTrie[K comparable] struct {
+	root *prefixNode[K]
+}
+
+type prefixNode[K comparable] struct {
+	label    string           // bytes from the parent to this node
+	children []*prefixNode[K] // by the first byte of their label
+	key      K
+	leaf     bool
+}
+
+func newPrefixTrie[K comparable]() *prefixTrie[K] {
+	return &prefixTrie[K]{root: &prefixNode[K]{}}
+}
+
+// child returns the index of the child of n whose label starts with b, and
+// the child, or nil and the index to insert it at.
+func (n *prefixNode[K]) child(b byte) (int, *prefixNode[K]) {
+	i := sort.Search(len(n.children), func(i int) bool { return n.children[i].label[0] >= b })
+	if i < len(n.children) && n.children[i].label[0] == b {
+		return i, n.children[i]
+	}
+	return i, nil
+}
+
+func (t *prefixTrie[K]) insert(s string, key K) {
+	n := t.root
+	for s != "" {
+		i, child := n.child(s[0])
+		if child == nil {
+			n.children = append(n.children, nil)
+			copy(n.children[i+1:], n.children[i:])
+			n.children[i] = &prefixNode[K]{label: s, key: key, leaf: true}
+			return
+		}
+		common := commonPrefixLen(child.label, s)
+		if common < len(child.label) {
+			// Split the edge where s leaves it.
+			mid := &prefixNode[K]{label: child.label[:common], children: []*prefixNode[K]{child}}
+			child.label = child.label[common:]
+			n.children[i] = mid
+			child = mid
+		}
+		n, s = child, s[common:]
+	}
+	n.key = key
+	n.leaf = true
+}
+
+// remove deletes s and merges the nodes left without a key and with a
+// single child into that child.
+func (t *prefixTrie[K]) remove(s string) {
+	var parents []*prefixNode[K]
+	n := t.root
+	for s != "" {
+		_, child := n.child(s[0])
+		if child == nil || !strings.HasPrefix(s, child.label) {
+			return
+		}
+		parents = append(parents, n)
+		n, s = child, s[len(child.label):]
+	}
+	var zero K
+	n.key, n.leaf = zero, false
+	if n == t.root {
+		return
+	}
+	parent := parents[len(parents)-1]
+	switch len(n.children) {
+	case 0:
+		j, _ := parent.child(n.label[0])
+		parent.children = append(parent.children[:j], parent.children[j+1:]...)
+		if parent != t.root && !parent.leaf && len(parent.children) == 1 {
+			mergeChild(parents[len(parents)-2], parent)
+		}
+	case 1:
+		mergeChild(parent, n)
+	}
+}
+
+// mergeChild replaces n, a child of parent with a single child of its own,
+// by that child.
+func mergeChild[K comparable](parent, n *prefixNode[K]) {
+	only := n.children[0]
+	only.label = n.label + only.label
+	j, _ := parent.child(n.label[0])
+	parent.children[j] = only
+}
+
+// withPrefix returns the keys whose string form starts with prefix.
+func (t *prefixTrie[K]) withPrefix(prefix string) []K {
+	n := t.root
+	for prefix != "" {
+		_, child := n.child(prefix[0])
+		if child == nil {
+			return nil
+		}
+		if len(prefix) <= len(child.label) {
+			if !strings.HasPrefix(child.label, prefix) {
+				return nil
+			}
+			n = child
+			break
+		}
+		if !strings.HasPrefix(prefix, child.label) {
+			return nil
+		}
+		n, prefix = child, prefix[len(child.label):]
+	}
+	var keys []K
+	var walk func(*prefixNode[K])
+	walk = func(n *prefixNode[K]) {
+		if n.leaf {
+			keys = append(keys, n.key)
+		}
+		for _, child := range n.children {
+			walk(child)
+		}
+	}
+	walk(n)
+	return keys
+}
+
+func commonPrefixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// CacheCodec encodes and decodes the snapshots written by SaveTo.
+type CacheCodec interface {
+	Encode(w io.Writer, v interface{}) error
+	Decode(r io.Reader, v interface{}) error
+}
+
+// GobCodec encodes snapshots with encoding/gob. It is the default codec.
+// Concrete types stored in interface{} values must be registered with
+// gob.Register.
+type GobCodec struct{}
+
+// Encode writes v to w.
+func (GobCodec) Encode(w io.Writer, v interface{}) error {
+	return gob.NewEncoder(w).Encode(v)
+}
+
+// Decode reads v from r.
+func (GobCodec) Decode(r io.Reader, v interface{}) error {
+	return gob.NewDecoder(r).Decode(v)
+}
+
+// JSONCodec encodes snapshots with encoding/json. interface{} values come
+// back as the generic JSON types (map[string]interface{}, float64, ...).
+type JSONCodec struct{}
+
+// Encode writes v to w.
+func (JSONCodec) Encode(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// Decode reads v from r.
+func (JSONCodec) Decode(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+// WithCodec sets the codec used by SaveTo and LoadFrom.
+func WithCodec(codec CacheCodec) CacheOption {
+	return func(c *cacheConfig) {
+		c.codec = codec
+	}
+}
+
+// WithSnapshotFile restores the cache from path when it is created and
+// saves it back to path every interval and on Close. Files are replaced
+// atomically, so a crash never leaves a partial snapshot behind.
+func WithSnapshotFile(path string, interval time.Duration) CacheOption {
+	return func(c *cacheConfig) {
+		c.snapshotPath = path
+		c.snapshotInterval = interval
+	}
+}
+
+// cacheSnapshot is the serialized form of a cache.
+type cacheSnapshot[K comparable, V any] struct {
+	SavedAt time.Time
+	Entries []cacheSnapshotEntry[K, V]
+}
+
+// cacheSnapshotEntry is one serialized entry.
+type cacheSnapshotEntry[K comparable, V any] struct {
+	Key   K
+	Value V
+	TTL   time.Duration // remaining at SavedAt, 0 means never expire
+	Tags  []string
+}
+
+func (c *Cache[K, V]) codec() CacheCodec {
+	if c.config.codec != nil {
+		return c.config.codec
+	}
+	return GobCodec{}
+}
+
+// SaveTo writes all unexpired entries and their remaining TTLs to w.
+func (c *Cache[K, V]) SaveTo(w io.Writer) error {
+	now := time.Now()
+	snap := cacheSnapshot[K, V]{SavedAt: now}
+	for _, e := range c.snapshot() {
+		var ttl time.Duration
+		if !e.expireAt.IsZero() {
+			ttl = e.expireAt.Sub(now)
+		}
+		snap.Entries = append(snap.Entries, cacheSnapshotEntry[K, V]{Key: e.key, Value: e.value, TTL: ttl, Tags: e.tags})
+	}
+	return c.codec().Encode(w, &snap)
+}
+
+// LoadFrom adds the entries written by SaveTo to the cache. The time passed
+// since the snapshot was saved is subtracted from each TTL and entries that
+// expired in the meantime are dropped.
+func (c *Cache[K, V]) LoadFrom(r io.Reader) error {
+	var snap cacheSnapshot[K, V]
+	if err := c.codec().Decode(r, &snap); err != nil {
+		return err
+	}
+	elapsed := time.Since(snap.SavedAt)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	// Entries are saved from the most to the least recently used; insert
+	// them backwards to restore that order.
+	for i := len(snap.Entries) - 1; i >= 0; i-- {
+		e := snap.Entries[i]
+		ttl := e.TTL
+		if ttl > 0 {
+			if ttl -= elapsed; ttl <= 0 {
+				continue
+			}
+		}
+		c.set(e.Key, e.Value, ttl, e.Tags)
+	}
+	return nil
+}
+
+// SaveFile writes a snapshot to fp, replacing it atomically.
+func (c *Cache[K, V]) SaveFile(fp string) error {
+	if err := EnsureDir(Dir(fp)); err != nil {
+		return err
+	}
+	// A temp file of its own, so concurrent saves to fp, e.g. by the
+	// snapshotter and a caller, do not write into each other's file.
+	f, err := os.CreateTemp(Dir(fp), Basename(fp)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	w := bufio.NewWriter(f)
+	if err = f.Chmod(0644); err == nil {
+		err = c.SaveTo(w)
+	}
+	if err == nil {
+		if err = w.Flush(); err == nil {
+			err = f.Sync()
+		}
+	}
+	if cerr := Close(f); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		Remove(tmp)
+		return err
+	}
+	return Rename(tmp, fp)
+}
+
+// LoadFile restores a snapshot written by SaveFile.
+func (c *Cache[K, V]) LoadFile(fp string) error {
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer Close(f)
+	return c.LoadFrom(bufio.NewReader(f))
+}
+
+// snapshotter saves the cache to the snapshot file every interval until
+// the cache is closed, then saves it one last time.
+func (c *Cache[K, V]) snapshotter(interval time.Duration) {
+	defer c.bg.Done()
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+			if err := c.SaveFile(c.config.snapshotPath); err != nil {
+				log.Printf("cache: save snapshot %s: %v", c.config.snapshotPath, err)
+			}
+		case <-c.stop:
+			if err := c.SaveFile(c.config.snapshotPath); err != nil {
+				log.Printf("cache: save snapshot %s: %v", c.config.snapshotPath, err)
+			}
+			return
+		}
+	}
+}
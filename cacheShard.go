@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// cacheShard is one lock-striped part of a Cache with its own LRU list.
+type cacheShard[K comparable, V any] struct {
+	mu       sync.Mutex
+	items    map[K]*list.Element
+	lru      *list.List // front is the most recently used entry
+	capacity int        // 0 means unlimited
+	bytes    int64      // sum of the entry sizes
+
+	// negative holds cached loader errors. Expired ones are swept whenever
+	// it grows to sweepAt entries, and it never holds more than capacity.
+	negative map[K]negativeEntry
+	sweepAt  int
+
+	// tags maps a tag to the keys stored with it.
+	tags map[string]map[K]struct{}
+	// prefixes indexes the keys by their string form; nil unless the cache
+	// was created WithPrefixIndex and K is a string type.
+	prefixes  *prefixTrie[K]
+	keyString func(K) string
+}
+
+func newCacheShard[K comparable, V any](capacity int, keyString func(K) string) *cacheShard[K, V] {
+	s := &cacheShard[K, V]{
+		items:     make(map[K]*list.Element),
+		lru:       list.New(),
+		capacity:  capacity,
+		negative:  make(map[K]negativeEntry),
+		sweepAt:   minNegativeSweep,
+		tags:      make(map[string]map[K]struct{}),
+		keyString: keyString,
+	}
+	if keyString != nil {
+		s.prefixes = newPrefixTrie[K]()
+	}
+	return s
+}
+
+// set stores value under key with the given tags, replacing any previous
+// tags, and returns the entries evicted to make room. The caller must hold
+// s.mu.
+func (s *cacheShard[K, V]) set(key K, value V, expireAt time.Time, size int64, tags []string) []cacheEviction[K, V] {
+	delete(s.negative, key)
+	if el, ok := s.items[key]; ok {
+		e := el.Value.(*cacheEntry[K, V])
+		s.bytes += size - e.size
+		e.value = value
+		e.expireAt = expireAt
+		e.size = size
+		s.untag(e)
+		e.tags = tags
+		s.tag(e)
+		s.lru.MoveToFront(el)
+		return nil
+	}
+	e := &cacheEntry[K, V]{key: key, value: value, expireAt: expireAt, size: size, tags: tags}
+	s.items[key] = s.lru.PushFront(e)
+	s.bytes += size
+	s.tag(e)
+	if s.prefixes != nil {
+		s.prefixes.insert(s.keyString(key), key)
+	}
+	var evicted []cacheEviction[K, V]
+	if s.capacity > 0 {
+		for s.lru.Len() > s.capacity {
+			evicted = append(evicted, s.removeElement(s.lru.Back(), EvictCapacity))
+		}
+	}
+	return evicted
+}
+
+// minNegativeSweep is the smallest size at which setNegative sweeps expired
+// negative entries.
+const minNegativeSweep = 64
+
+// setNegative caches err for key until expireAt. Expired negative entries
+// are removed once the map has doubled since the last sweep, so the cost
+// is amortized; with a capacity the entry closest to expiring makes room.
+// The caller must hold s.mu.
+func (s *cacheShard[K, V]) setNegative(key K, err error, now, expireAt time.Time) {
+	if _, ok := s.negative[key]; !ok {
+		if len(s.negative) >= s.sweepAt {
+			for k, n := range s.negative {
+				if !now.Before(n.expireAt) {
+					delete(s.negative, k)
+				}
+			}
+			s.sweepAt = max(2*len(s.negative), minNegativeSweep)
+		}
+		if s.capacity > 0 && len(s.negative) >= s.capacity {
+			var oldest K
+			first := true
+			for k, n := range s.negative {
+				if first || n.expireAt.Before(s.negative[oldest].expireAt) {
+					oldest, first = k, false
+				}
+			}
+			delete(s.negative, oldest)
+		}
+	}
+	s.negative[key] = negativeEntry{err: err, expireAt: expireAt}
+}
+
+// clearExpired removes entries past their stale window and expired negative
+// entries. The caller must hold s.mu.
+func (s *cacheShard[K, V]) clearExpired(now time.Time, stale time.Duration) []cacheEviction[K, V] {
+	for k, n := range s.negative {
+		if !now.Before(n.expireAt) {
+			delete(s.negative, k)
+		}
+	}
+	var evicted []cacheEviction[K, V]
+	for el := s.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if el.Value.(*cacheEntry[K, V]).dead(now, stale) {
+			evicted = append(evicted, s.removeElement(el, EvictExpired))
+		}
+		el = prev
+	}
+	return evicted
+}
+
+// removeElement unlinks el. The caller must hold s.mu.
+func (s *cacheShard[K, V]) removeElement(el *list.Element, reason EvictReason) cacheEviction[K, V] {
+	e := el.Value.(*cacheEntry[K, V])
+	s.lru.Remove(el)
+	delete(s.items, e.key)
+	s.bytes -= e.size
+	s.untag(e)
+	if s.prefixes != nil {
+		s.prefixes.remove(s.keyString(e.key))
+	}
+	return cacheEviction[K, V]{entry: e, reason: reason}
+}
+
+// hashKey hashes a cache key for shard selection. Strings and integers are
+// hashed without allocating; other key types fall back to their fmt form.
+func hashKey[K comparable](key K) uint64 {
+	switch k := any(key).(type) {
+	case string:
+		return fnv1a(k)
+	case int:
+		return mix64(uint64(k))
+	case int32:
+		return mix64(uint64(k))
+	case int64:
+		return mix64(uint64(k))
+	case uint:
+		return mix64(uint64(k))
+	case uint32:
+		return mix64(uint64(k))
+	case uint64:
+		return mix64(k)
+	}
+	h := fnv.New64a()
+	fmt.Fprint(h, key)
+	return h.Sum64()
+}
+
+// fnv1a is the 64-bit FNV-1a hash of s.
+func fnv1a(s string) uint64 {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	h := uint64(offset64)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= prime64
+	}
+	return h
+}
+
+// mix64 scrambles the bits of an integer key (splitmix64 finalizer) so that
+// sequential keys spread over all shards.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// entryOverhead approximates the bytes a cache spends per entry besides its
+// key and value: the list element, the map slot and the entry metadata.
+const entryOverhead = 128
+
+// CacheStats is a point-in-time snapshot of the counters of a cache.
+type CacheStats struct {
+	Hits       uint64 // lookups served from the cache, including stale values
+	Misses     uint64 // lookups that found no usable entry
+	Loads      uint64 // GetOrLoad loader calls
+	LoadErrors uint64 // loader calls that returned an error or panicked
+
+	EvictedExpired  uint64 // entries removed after their TTL
+	EvictedCapacity uint64 // entries removed by LRU eviction
+	EvictedDeleted  uint64 // entries removed by Delete
+
+	Entries int   // current number of entries
+	Bytes   int64 // approximate memory held by the entries
+}
+
+// HitRatio returns Hits / (Hits + Misses), or 0 when there were no lookups.
+func (s CacheStats) HitRatio() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+// CacheMetrics receives cache events as they happen, so they can be
+// forwarded to an external metrics system. Implementations must be safe for
+// concurrent use and should return quickly.
+type CacheMetrics interface {
+	Hit()
+	Miss()
+	Load(d time.Duration, err error)
+	Evict(reason EvictReason)
+}
+
+// WithMetrics forwards cache events to m in addition to the built-in
+// counters reported by Stats.
+func WithMetrics(m CacheMetrics) CacheOption {
+	return func(c *cacheConfig) {
+		c.metrics = m
+	}
+}
+
+// WithSizer replaces the built-in estimate of the bytes used by an entry,
+// which only looks at the top level of key and value.
+func WithSizer(fn func(key, value interface{}) int64) CacheOption {
+	return func(c *cacheConfig) {
+		c.sizer = fn
+	}
+}
+
+// cacheCounters are the counters behind CacheStats.
+type cacheCounters struct {
+	hits, misses      atomic.Uint64
+	loads, loadErrors atomic.Uint64
+	evicted           [EvictDeleted + 1]atomic.Uint64
+}
+
+func (cc *cacheCounters) reset() {
+	cc.hits.Store(0)
+	cc.misses.Store(0)
+	cc.loads.Store(0)
+	cc.loadErrors.Store(0)
+	for i := range cc.evicted {
+		cc.evicted[i].Store(0)
+	}
+}
+
+// Stats returns a snapshot of the cache counters.
+func (c *Cache[K, V]) Stats() CacheStats {
+	st := CacheStats{
+		Hits:            c.counters.hits.Load(),
+		Misses:          c.counters.misses.Load(),
+		Loads:           c.counters.loads.Load(),
+		LoadErrors:      c.counters.loadErrors.Load(),
+		EvictedExpired:  c.counters.evicted[EvictExpired].Load(),
+		EvictedCapacity: c.counters.evicted[EvictCapacity].Load(),
+		EvictedDeleted:  c.counters.evicted[EvictDeleted].Load(),
+	}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		st.Entries += s.lru.Len()
+		st.Bytes += s.bytes
+		s.mu.Unlock()
+	}
+	return st
+}
+
+// ResetStats zeroes the counters reported by Stats. Entries and Bytes
+// describe the current contents and are not affected.
+func (c *Cache[K, V]) ResetStats() {
+	c.counters.reset()
+}
+
+func (c *Cache[K, V]) hit() {
+	c.counters.hits.Add(1)
+	if m := c.config.metrics; m != nil {
+		m.Hit()
+	}
+}
+
+func (c *Cache[K, V]) miss() {
+	c.counters.misses.Add(1)
+	if m := c.config.metrics; m != nil {
+		m.Miss()
+	}
+}
+
+func (c *Cache[K, V]) loaded(d time.Duration, err error) {
+	c.counters.loads.Add(1)
+	if err != nil {
+		c.counters.loadErrors.Add(1)
+	}
+	if m := c.config.metrics; m != nil {
+		m.Load(d, err)
+	}
+}
+
+func (c *Cache[K, V]) evicted(reason EvictReason) {
+	if reason >= EvictExpired && reason <= EvictDeleted {
+		c.counters.evicted[reason].Add(1)
+	}
+	if m := c.config.metrics; m != nil {
+		m.Evict(reason)
+	}
+}
+
+// sizeOf estimates the bytes held by an entry.
+func (c *Cache[K, V]) sizeOf(key K, value V) int64 {
+	if c.config.sizer != nil {
+		return c.config.sizer(key, value) + entryOverhead
+	}
+	return approxSize(key) + approxSize(value) + entryOverhead
+}
+
+// approxSize estimates the memory used by v without following pointers,
+// except for the contents of strings and byte slices.
+func approxSize(v interface{}) int64 {
+	switch x := v.(type) {
+	case nil:
+		return 0
+	case string:
+		return int64(16 + len(x))
+	case []byte:
+		return int64(24 + cap(x))
+	}
+	rv := reflect.ValueOf(v)
+	size := int64(rv.Type().Size())
+	switch rv.Kind() {
+	case reflect.String:
+		size += int64(rv.Len())
+	case reflect.Slice:
+		size += int64(rv.Cap()) * int64(rv.Type().Elem().Size())
+	}
+	return size
+}
@@ -0,0 +1,494 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheOf(t *testing.T) {
+	c := NewCacheOf[int, string](WithCapacity(3))
+	for i := 1; i <= 3; i++ {
+		c.Set(i, string(rune('a'+i-1)))
+	}
+	if v, ok := c.Get(2); !ok || v != "b" {
+		t.Fatalf("Get(2) = %q, %v; want b, true", v, ok)
+	}
+	c.SetWithTTL(4, "d", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	keys := c.Keys()
+	sort.Ints(keys)
+	equal(t, []int{2, 3}, keys)
+	if c.Len() != 3 {
+		t.Errorf("Len() = %d; want 3", c.Len())
+	}
+
+	c.Delete(2)
+	seen := 0
+	c.Range(func(k int, v string) bool {
+		seen++
+		if k != 3 || v != "c" {
+			t.Errorf("Range got %d=%q; want 3=c", k, v)
+		}
+		return true
+	})
+	if seen != 1 {
+		t.Errorf("Range visited %d entries; want 1", seen)
+	}
+}
+
+func TestCacheGetOrLoad(t *testing.T) {
+	c := NewCacheOf[string, int]()
+	calls := 0
+	loader := func() (int, error) {
+		calls++
+		return 42, nil
+	}
+	for i := 0; i < 3; i++ {
+		if v, err := c.GetOrLoad("k", loader); err != nil || v != 42 {
+			t.Fatalf("GetOrLoad = %d, %v; want 42, nil", v, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("loader called %d times; want 1", calls)
+	}
+
+	errLoad := errors.New("load failed")
+	if _, err := c.GetOrLoad("bad", func() (int, error) { return 0, errLoad }); err != errLoad {
+		t.Errorf("GetOrLoad error = %v; want %v", err, errLoad)
+	}
+	if _, ok := c.Get("bad"); ok {
+		t.Errorf("failed load should not be cached")
+	}
+}
+
+func TestCacheGetOrLoadSingleflight(t *testing.T) {
+	c := NewCacheOf[string, int]()
+	var calls int32
+	release := make(chan struct{})
+	loader := func() (int, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return 7, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := c.GetOrLoad("k", loader); err != nil || v != 7 {
+				t.Errorf("GetOrLoad = %d, %v; want 7, nil", v, err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("loader called %d times; want 1", n)
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	c := NewCacheOf[string, int](WithTTL(10*time.Millisecond), WithStaleWhileRevalidate(time.Minute))
+	c.Set("k", 1)
+	time.Sleep(15 * time.Millisecond)
+
+	refreshed := make(chan struct{})
+	v, err := c.GetOrLoad("k", func() (int, error) {
+		defer close(refreshed)
+		return 2, nil
+	})
+	if err != nil || v != 1 {
+		t.Fatalf("GetOrLoad = %d, %v; want stale 1, nil", v, err)
+	}
+	<-refreshed
+	for i := 0; i < 100; i++ {
+		if v, ok := c.Get("k"); ok && v == 2 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Errorf("background refresh did not store the new value")
+}
+
+func TestCacheStaleRefreshPanic(t *testing.T) {
+	c := NewCacheOf[string, int](WithTTL(10*time.Millisecond), WithStaleWhileRevalidate(time.Minute))
+	c.Set("k", 1)
+	time.Sleep(15 * time.Millisecond)
+
+	v, err := c.GetOrLoad("k", func() (int, error) { panic("boom") })
+	if err != nil || v != 1 {
+		t.Fatalf("GetOrLoad = %d, %v; want stale 1, nil", v, err)
+	}
+	for i := 0; i < 100 && c.Stats().LoadErrors == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := c.Stats().LoadErrors; n != 1 {
+		t.Fatalf("LoadErrors = %d after a panicking refresh; want 1", n)
+	}
+	v, err = c.GetOrLoad("k", func() (int, error) { panic("boom") })
+	if err != nil || v != 1 {
+		t.Errorf("GetOrLoad after the panic = %d, %v; want stale 1, nil", v, err)
+	}
+}
+
+func TestCacheCloseStopsJanitor(t *testing.T) {
+	c := NewCacheOf[string, int](WithJanitor(time.Millisecond))
+	c.Close()
+	var evicted int32
+	c.OnEvict(func(string, int, EvictReason) { atomic.AddInt32(&evicted, 1) })
+	c.SetWithTTL("k", 1, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&evicted); n != 0 {
+		t.Errorf("janitor evicted %d entries after Close", n)
+	}
+}
+
+func TestCacheNegativeTTL(t *testing.T) {
+	c := NewCacheOf[string, int](WithNegativeTTL(time.Minute))
+	errLoad := errors.New("load failed")
+	calls := 0
+	loader := func() (int, error) {
+		calls++
+		return 0, errLoad
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := c.GetOrLoad("k", loader); err != errLoad {
+			t.Fatalf("GetOrLoad error = %v; want %v", err, errLoad)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("loader called %d times; want 1", calls)
+	}
+
+	c.Set("k", 3)
+	if v, err := c.GetOrLoad("k", loader); err != nil || v != 3 {
+		t.Errorf("GetOrLoad after Set = %d, %v; want 3, nil", v, err)
+	}
+}
+
+func TestCacheNegativeBounded(t *testing.T) {
+	errLoad := errors.New("load failed")
+	loader := func() (int, error) { return 0, errLoad }
+	negatives := func(c *Cache[int, int]) int {
+		n := 0
+		for _, s := range c.shards {
+			s.mu.Lock()
+			n += len(s.negative)
+			s.mu.Unlock()
+		}
+		return n
+	}
+
+	c := NewCacheOf[int, int](WithCapacity(100), WithNegativeTTL(time.Hour))
+	for i := 0; i < 1000; i++ {
+		c.GetOrLoad(i, loader)
+	}
+	if n := negatives(c); n != 100 {
+		t.Errorf("%d negative entries with capacity 100; want 100", n)
+	}
+	if _, err := c.GetOrLoad(999, func() (int, error) { return 1, nil }); err != errLoad {
+		t.Errorf("GetOrLoad(999) error = %v; want the cached %v", err, errLoad)
+	}
+
+	c = NewCacheOf[int, int](WithNegativeTTL(time.Nanosecond))
+	for i := 0; i < 10000; i++ {
+		c.GetOrLoad(i, loader)
+	}
+	if n := negatives(c); n > 2*minNegativeSweep {
+		t.Errorf("%d expired negative entries kept; want at most %d", n, 2*minNegativeSweep)
+	}
+}
+
+func TestCacheShards(t *testing.T) {
+	c := NewCacheOf[int, int](WithShards(8), WithCapacity(800))
+	if len(c.shards) != 8 {
+		t.Fatalf("len(shards) = %d; want 8", len(c.shards))
+	}
+	for i := 0; i < 1000; i++ {
+		c.Set(i, i*i)
+	}
+	if n := c.Len(); n > 800 || n < 700 {
+		t.Errorf("Len() = %d; want about 800", n)
+	}
+	for i := 999; i > 990; i-- {
+		if v, ok := c.Get(i); !ok || v != i*i {
+			t.Errorf("Get(%d) = %d, %v; want %d, true", i, v, ok, i*i)
+		}
+	}
+	for _, s := range c.shards {
+		if s.lru.Len() == 0 {
+			t.Errorf("keys are not spread over all shards")
+		}
+	}
+}
+
+// syncMapCache mirrors the original Application design of two parallel
+// sync.Maps and serves as a baseline for the benchmarks.
+type syncMapCache struct {
+	values  sync.Map
+	expires sync.Map
+}
+
+func (c *syncMapCache) Set(key string, value interface{}) {
+	c.values.Store(key, value)
+	c.expires.Store(key, time.Now().Unix())
+}
+
+func (c *syncMapCache) Get(key string) (interface{}, bool) {
+	return c.values.Load(key)
+}
+
+type benchCache interface {
+	Set(key string, value interface{})
+	Get(key string) (interface{}, bool)
+}
+
+func benchmarkCache(b *testing.B, c benchCache, writePercent int) {
+	const keys = 4096
+	names := make([]string, keys)
+	for i := range names {
+		names[i] = "key:" + strconv.Itoa(i)
+		c.Set(names[i], i)
+	}
+	var seed uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(int64(atomic.AddUint32(&seed, 1))))
+		for pb.Next() {
+			k := names[r.Intn(keys)]
+			if r.Intn(100) < writePercent {
+				c.Set(k, k)
+			} else {
+				c.Get(k)
+			}
+		}
+	})
+}
+
+func BenchmarkCache(b *testing.B) {
+	for _, writes := range []int{10, 50, 90} {
+		suffix := "/writes=" + strconv.Itoa(writes) + "%"
+		b.Run("syncMap"+suffix, func(b *testing.B) {
+			benchmarkCache(b, &syncMapCache{}, writes)
+		})
+		b.Run("single"+suffix, func(b *testing.B) {
+			benchmarkCache(b, NewCacheOf[string, interface{}](WithTTL(time.Minute)), writes)
+		})
+		b.Run("sharded"+suffix, func(b *testing.B) {
+			benchmarkCache(b, NewCacheOf[string, interface{}](WithTTL(time.Minute), WithShards(32)), writes)
+		})
+	}
+}
+
+type countingMetrics struct {
+	hits, misses, loads, evictions int32
+}
+
+func (m *countingMetrics) Hit()                            { atomic.AddInt32(&m.hits, 1) }
+func (m *countingMetrics) Miss()                           { atomic.AddInt32(&m.misses, 1) }
+func (m *countingMetrics) Load(d time.Duration, err error) { atomic.AddInt32(&m.loads, 1) }
+func (m *countingMetrics) Evict(reason EvictReason)        { atomic.AddInt32(&m.evictions, 1) }
+
+func TestCacheStats(t *testing.T) {
+	m := &countingMetrics{}
+	c := NewCacheOf[string, string](WithCapacity(2), WithMetrics(m))
+	c.Set("a", "x")
+	c.Get("a")
+	c.Get("b")
+	c.GetOrLoad("c", func() (string, error) { return "z", nil })
+	c.GetOrLoad("d", func() (string, error) { return "", errors.New("fail") })
+	c.Set("e", "y")
+	c.Delete("e")
+
+	st := c.Stats()
+	want := CacheStats{
+		Hits: 1, Misses: 3, Loads: 2, LoadErrors: 1,
+		EvictedCapacity: 1, EvictedDeleted: 1,
+		Entries: 1, Bytes: st.Bytes,
+	}
+	equal(t, want, st)
+	if st.Bytes <= entryOverhead {
+		t.Errorf("Bytes = %d; want more than one entry overhead", st.Bytes)
+	}
+	if m.hits != 1 || m.misses != 3 || m.loads != 2 || m.evictions != 2 {
+		t.Errorf("metrics = %+v; want 1 hit, 3 misses, 2 loads, 2 evictions", *m)
+	}
+
+	c.ResetStats()
+	st = c.Stats()
+	if st.Hits != 0 || st.Misses != 0 || st.Entries != 1 {
+		t.Errorf("after ResetStats = %+v; want zero counters and 1 entry", st)
+	}
+}
+
+func TestCacheSaveLoad(t *testing.T) {
+	for _, codec := range []CacheCodec{GobCodec{}, JSONCodec{}} {
+		src := NewCacheOf[string, int](WithCodec(codec))
+		src.Set("forever", 1)
+		src.SetWithTTL("later", 2, time.Hour)
+		src.SetWithTTL("soon", 3, 30*time.Millisecond)
+
+		var buf bytes.Buffer
+		if err := src.SaveTo(&buf); err != nil {
+			t.Fatalf("%T: SaveTo: %v", codec, err)
+		}
+		time.Sleep(40 * time.Millisecond)
+
+		dst := NewCacheOf[string, int](WithCodec(codec))
+		if err := dst.LoadFrom(&buf); err != nil {
+			t.Fatalf("%T: LoadFrom: %v", codec, err)
+		}
+		keys := dst.Keys()
+		sort.Strings(keys)
+		equal(t, []string{"forever", "later"}, keys)
+
+		s := dst.shards[0]
+		exp := s.items["later"].Value.(*cacheEntry[string, int]).expireAt
+		if d := time.Until(exp); d > time.Hour || d < 59*time.Minute {
+			t.Errorf("%T: remaining TTL of later = %v; want about 1h", codec, d)
+		}
+	}
+}
+
+func TestCacheSnapshotFile(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "snap", "cache.gob")
+
+	c := NewCacheOf[string, string](WithSnapshotFile(fp, time.Hour))
+	c.Set("k", "v")
+
+	// Saves to the same file may overlap.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.SaveFile(fp); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	c.Close()
+	if files, _ := filepath.Glob(filepath.Join(filepath.Dir(fp), "*")); !IsFile(fp) || len(files) != 1 {
+		t.Fatalf("Close should leave only the snapshot file at %s, found %v", fp, files)
+	}
+
+	restored := NewCacheOf[string, string](WithSnapshotFile(fp, time.Hour))
+	defer restored.Close()
+	if v, ok := restored.Get("k"); !ok || v != "v" {
+		t.Errorf("restored Get(k) = %q, %v; want v, true", v, ok)
+	}
+}
+
+func TestCacheInvalidationCountsLive(t *testing.T) {
+	for _, opts := range [][]CacheOption{nil, {WithPrefixIndex()}} {
+		c := NewCacheOf[string, int](opts...)
+		var evicted int32
+		c.OnEvict(func(string, int, EvictReason) { atomic.AddInt32(&evicted, 1) })
+		c.SetWithTags("a:1", 1, "t")
+		c.SetWithTags("a:2", 2, "t")
+		c.SetWithTTL("a:3", 3, time.Millisecond)
+		c.SetWithTTL("b:1", 4, time.Millisecond)
+		c.SetWithTags("b:2", 5, "t")
+		time.Sleep(5 * time.Millisecond)
+
+		// Expired entries waiting for the janitor are removed but not
+		// counted.
+		if n := c.DeletePrefix("a:"); n != 2 {
+			t.Errorf("DeletePrefix(a:) = %d; want 2 live entries", n)
+		}
+		if n := c.InvalidateTag("t"); n != 1 {
+			t.Errorf("InvalidateTag(t) = %d; want 1 live entry", n)
+		}
+		if n := c.DeletePrefix(""); n != 0 {
+			t.Errorf("DeletePrefix(\"\") = %d; want 0 live entries", n)
+		}
+		if n := atomic.LoadInt32(&evicted); n != 5 {
+			t.Errorf("OnEvict called %d times; want 5", n)
+		}
+	}
+}
+
+func TestPrefixTrie(t *testing.T) {
+	trie := newPrefixTrie[string]()
+	keys := make(map[string]bool)
+	r := rand.New(rand.NewSource(1))
+	randKey := func() string {
+		b := make([]byte, r.Intn(6))
+		for i := range b {
+			b[i] = "abc:"[r.Intn(4)]
+		}
+		return string(b)
+	}
+	for i := 0; i < 5000; i++ {
+		k := randKey()
+		if r.Intn(3) == 0 {
+			trie.remove(k)
+			delete(keys, k)
+		} else {
+			trie.insert(k, k)
+			keys[k] = true
+		}
+
+		prefix := randKey()
+		if len(prefix) > 2 {
+			prefix = prefix[:2]
+		}
+		var want []string
+		for k := range keys {
+			if strings.HasPrefix(k, prefix) {
+				want = append(want, k)
+			}
+		}
+		got := trie.withPrefix(prefix)
+		sort.Strings(want)
+		sort.Strings(got)
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Fatalf("step %d: withPrefix(%q) = %q; want %q", i, prefix, got, want)
+		}
+	}
+}
+
+func TestCacheIndexConcurrent(t *testing.T) {
+	type key string
+	c := NewCacheOf[key, int](WithShards(4), WithCapacity(64), WithPrefixIndex())
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				k := key("t" + strconv.Itoa(i%8) + ":" + strconv.Itoa(w*1000+i))
+				c.SetWithTags(k, i, "t"+strconv.Itoa(i%8))
+				if i%50 == 0 {
+					c.InvalidateTag("t3")
+					c.DeletePrefix("t5:")
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for _, s := range c.shards {
+		tagged := 0
+		for _, keys := range s.tags {
+			tagged += len(keys)
+		}
+		if tagged != len(s.items) || len(s.prefixes.withPrefix("")) != len(s.items) {
+			t.Errorf("index out of sync: %d items, %d tagged", len(s.items), tagged)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock tells the time and makes timers. The scheduler and the Now helpers
+// use it instead of the time package, so tests can substitute a FakeClock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) ClockTimer
+}
+
+// ClockTimer is a timer made by a Clock; see time.Timer.
+type ClockTimer interface {
+	// C returns the channel the time is sent on when the timer fires.
+	C() <-chan time.Time
+	// Stop prevents the timer from firing. It returns false if the timer
+	// already fired or was stopped.
+	Stop() bool
+}
+
+// defaultClock holds the clock returned by DefaultClock, boxed so that
+// clocks of different types can be stored.
+var defaultClock atomic.Value
+
+type clockBox struct{ Clock }
+
+// DefaultClock returns the clock used by the Now helpers and by schedulers
+// created without WithClock, including DefaultScheduler. It is the system
+// clock unless replaced with SetDefaultClock.
+func DefaultClock() Clock {
+	if b, ok := defaultClock.Load().(clockBox); ok {
+		return b.Clock
+	}
+	return realClock{}
+}
+
+// SetDefaultClock replaces the clock returned by DefaultClock; nil restores
+// the system clock. Schedulers without a clock of their own, and their
+// tasks, pick up the new clock the next time they read the time.
+func SetDefaultClock(c Clock) {
+	if c == nil {
+		c = realClock{}
+	}
+	defaultClock.Store(clockBox{c})
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) ClockTimer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+// WithClock makes the scheduler, and the tasks added to it, use c instead
+// of DefaultClock.
+func WithClock(c Clock) SchedulerOption {
+	return func(s *Scheduler) {
+		s.clock = c
+	}
+}
+
+// FakeClock is a Clock for tests. Its time only moves when it is advanced,
+// firing the timers that come due on the way.
+type FakeClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond // signaled when a timer is added
+	now    time.Time
+	timers []*fakeTimer // pending, by deadline, then creation
+}
+
+// NewFakeClock returns a FakeClock set to now.
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer returns a timer that fires once the clock is advanced by d. A
+// timer with d <= 0 fires at once.
+func (c *FakeClock) NewTimer(d time.Duration) ClockTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1), when: c.now.Add(d)}
+	if d <= 0 {
+		t.c <- c.now
+		return t
+	}
+	i := sort.Search(len(c.timers), func(i int) bool { return c.timers[i].when.After(t.when) })
+	c.timers = append(c.timers, nil)
+	copy(c.timers[i+1:], c.timers[i:])
+	c.timers[i] = t
+	c.cond.Broadcast()
+	return t
+}
+
+// Advance moves the clock forward by d. The timers that come due fire in
+// the order of their deadlines, each with the clock set to its deadline.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for len(c.timers) > 0 && !c.timers[0].when.After(end) {
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		if t.when.After(c.now) {
+			c.now = t.when
+		}
+		// The channel has room: a timer fires at most once.
+		t.c <- c.now
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// BlockUntil waits until at least n timers are pending, e.g. until the
+// scheduler under test waits for its next run.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+// Pending returns the number of timers that have not fired or been
+// stopped.
+func (c *FakeClock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	c     chan time.Time
+	when  time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, p := range c.timers {
+		if p == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
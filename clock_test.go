@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFakeClock(start)
+	late := c.NewTimer(3 * time.Second)
+	early := c.NewTimer(time.Second)
+	stopped := c.NewTimer(2 * time.Second)
+	if !stopped.Stop() {
+		t.Error("Stop of a pending timer returned false")
+	}
+	equal(t, 2, c.Pending())
+
+	c.Advance(1500 * time.Millisecond)
+	select {
+	case got := <-early.C():
+		equal(t, start.Add(time.Second), got)
+	default:
+		t.Fatal("timer due after 1s did not fire")
+	}
+	select {
+	case <-late.C():
+		t.Fatal("timer due after 3s fired after 1.5s")
+	default:
+	}
+	equal(t, start.Add(1500*time.Millisecond), c.Now())
+
+	c.Advance(time.Hour)
+	equal(t, start.Add(3*time.Second), <-late.C())
+	if late.Stop() {
+		t.Error("Stop of a fired timer returned true")
+	}
+	select {
+	case <-stopped.C():
+		t.Error("stopped timer fired")
+	default:
+	}
+
+	now := c.NewTimer(0)
+	equal(t, c.Now(), <-now.C())
+	equal(t, 0, c.Pending())
+}
@@ -1,49 +1,37 @@
 package utils
 
 import (
-	"fmt"
-	"sync"
 	"time"
 )
 
+// Application is a cache of interface{} values under string keys. It is a
+// thin wrapper around Cache kept for compatibility; new code should prefer
+// NewCacheOf with concrete types.
 type Application struct {
-	smCache    sync.Map
-	smCacheExt sync.Map
-	expire     int
+	*Cache[string, interface{}]
 }
 
-func NewCache(expire int) *Application {
-	app := &Application{expire: expire}
-	return app
+// NewCache creates a cache whose entries expire expire seconds after they
+// are stored. expire <= 0 disables the default expiration. The keys are
+// indexed for DeletePrefix, see WithPrefixIndex.
+func NewCache(expire int, opts ...CacheOption) *Application {
+	opts = append([]CacheOption{WithTTL(time.Duration(expire) * time.Second), WithPrefixIndex()}, opts...)
+	return &Application{Cache: NewCacheOf[string, interface{}](opts...)}
 }
 
+// Store stores value under key with the default TTL of the cache.
 func (app *Application) Store(key string, value interface{}) {
-	i := getCTime()
-	app.smCache.Store(key, value)
-	app.smCacheExt.Store(key, i)
-
-}
-
-func (app *Application) Get(key string) (interface{}, bool) {
-	return app.smCache.Load(key)
+	app.Set(key, value)
 }
 
-func (app *Application) ClearExpired() {
-	cTime := getCTime()
-
-	app.smCacheExt.Range(func(k, v interface{}) bool {
-		vTime := v.(int)
-		if vTime+60 < cTime {
-			app.smCacheExt.Delete(k)
-			app.smCache.Delete(k)
-			fmt.Println("deleting key:", k)
-		}
-		return true
-	})
-
+// StoreWithTTL stores value under key for ttl. ttl <= 0 means the entry
+// never expires.
+func (app *Application) StoreWithTTL(key string, value interface{}, ttl time.Duration) {
+	app.SetWithTTL(key, value, ttl)
 }
 
-func getCTime() int {
-
-	return int(time.Now().Unix())
+// StoreWithTags stores value under key with the default TTL and attaches
+// tags to it, so it can be removed with InvalidateTag.
+func (app *Application) StoreWithTags(key string, value interface{}, tags ...string) {
+	app.SetWithTags(key, value, tags...)
 }
@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheTTL(t *testing.T) {
+	app := NewCache(0)
+	app.StoreWithTTL("a", 1, 20*time.Millisecond)
+	app.Store("b", 2)
+
+	if v, ok := app.Get("a"); !ok || v != 1 {
+		t.Fatalf("Get(a) = %v, %v; want 1, true", v, ok)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := app.Get("a"); ok {
+		t.Errorf("Get(a) after TTL should miss")
+	}
+	if v, ok := app.Get("b"); !ok || v != 2 {
+		t.Errorf("Get(b) = %v, %v; want 2, true", v, ok)
+	}
+}
+
+func TestCacheDefaultTTL(t *testing.T) {
+	app := NewCache(1)
+	app.Store("a", 1)
+	s := app.shards[0]
+	s.mu.Lock()
+	s.items["a"].Value.(*cacheEntry[string, interface{}]).expireAt = time.Now().Add(-time.Second)
+	s.mu.Unlock()
+
+	app.ClearExpired()
+	if app.Len() != 0 {
+		t.Errorf("Len() = %d after ClearExpired; want 0", app.Len())
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	app := NewCache(0, WithCapacity(2))
+	app.Store("a", 1)
+	app.Store("b", 2)
+	app.Get("a")
+	app.Store("c", 3)
+
+	if _, ok := app.Get("b"); ok {
+		t.Errorf("least recently used key b should be evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, ok := app.Get(k); !ok {
+			t.Errorf("Get(%s) should hit", k)
+		}
+	}
+	if app.Len() != 2 {
+		t.Errorf("Len() = %d; want 2", app.Len())
+	}
+}
+
+func TestCacheOnEvict(t *testing.T) {
+	app := NewCache(0, WithCapacity(1))
+	got := make(map[string]EvictReason)
+	app.OnEvict(func(key string, value interface{}, reason EvictReason) {
+		got[key] = reason
+	})
+
+	app.Store("a", 1)
+	app.Store("b", 2)
+	app.StoreWithTTL("c", 3, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	app.ClearExpired()
+	app.Store("d", 4)
+	app.Delete("d")
+
+	want := map[string]EvictReason{
+		"a": EvictCapacity,
+		"b": EvictCapacity,
+		"c": EvictExpired,
+		"d": EvictDeleted,
+	}
+	for k, r := range want {
+		if got[k] != r {
+			t.Errorf("eviction of %s = %v; want %v", k, got[k], r)
+		}
+	}
+}
+
+func TestCacheJanitor(t *testing.T) {
+	app := NewCache(0, WithJanitor(5*time.Millisecond))
+	defer app.Close()
+
+	expired := make(chan string, 1)
+	app.OnEvict(func(key string, value interface{}, reason EvictReason) {
+		if reason == EvictExpired {
+			expired <- key
+		}
+	})
+	app.StoreWithTTL("a", 1, time.Millisecond)
+
+	select {
+	case k := <-expired:
+		if k != "a" {
+			t.Errorf("expired key = %s; want a", k)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("janitor did not remove the expired entry")
+	}
+	app.Close()
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	app := NewCache(0, WithShards(4))
+	for _, tenant := range []string{"1", "2", "42"} {
+		for _, k := range []string{"user", "plan", "quota"} {
+			app.StoreWithTags("tenant:"+tenant+":"+k, k, "tenant-"+tenant)
+		}
+	}
+	app.StoreWithTags("global", 0, "tenant-1", "tenant-2")
+
+	if n := app.DeletePrefix("tenant:4"); n != 3 {
+		t.Errorf("DeletePrefix(tenant:4) = %d; want 3", n)
+	}
+	if n := app.InvalidateTag("tenant-1"); n != 4 {
+		t.Errorf("InvalidateTag(tenant-1) = %d; want 4", n)
+	}
+	if n := app.InvalidateTag("tenant-2"); n != 3 {
+		t.Errorf("InvalidateTag(tenant-2) = %d; want 3", n)
+	}
+	if n := app.Len(); n != 0 {
+		t.Errorf("Len() = %d; want 0", n)
+	}
+
+	// Storing a key again replaces its tags.
+	app.StoreWithTags("k", 1, "old")
+	app.Store("k", 2)
+	if n := app.InvalidateTag("old"); n != 0 {
+		t.Errorf("InvalidateTag(old) = %d after retagging; want 0", n)
+	}
+	if n := app.DeletePrefix(""); n != 1 {
+		t.Errorf("DeletePrefix(\"\") = %d; want 1", n)
+	}
+}
@@ -51,18 +51,18 @@ func (config *Config) With(t time.Time) *Now {
 // Parse parse string to time based on configuration
 func (config *Config) Parse(strs ...string) (time.Time, error) {
 	if config.TimeLocation == nil {
-		return config.With(time.Now()).Parse(strs...)
+		return config.With(DefaultClock().Now()).Parse(strs...)
 	} else {
-		return config.With(time.Now().In(config.TimeLocation)).Parse(strs...)
+		return config.With(DefaultClock().Now().In(config.TimeLocation)).Parse(strs...)
 	}
 }
 
 // MustParse must parse string to time or will panic
 func (config *Config) MustParse(strs ...string) time.Time {
 	if config.TimeLocation == nil {
-		return config.With(time.Now()).MustParse(strs...)
+		return config.With(DefaultClock().Now()).MustParse(strs...)
 	} else {
-		return config.With(time.Now().In(config.TimeLocation)).MustParse(strs...)
+		return config.With(DefaultClock().Now().In(config.TimeLocation)).MustParse(strs...)
 	}
 }
 
@@ -93,182 +93,182 @@ func With(t time.Time) *Now {
 // BeginningOfMinute beginning of minute
 func BeginningOfMinute(locs ...*time.Location) time.Time {
 	if len(locs) == 0 {
-		return With(time.Now()).BeginningOfMinute()
+		return With(DefaultClock().Now()).BeginningOfMinute()
 	} else {
-		return With(time.Now().In(locs[0])).BeginningOfMinute()
+		return With(DefaultClock().Now().In(locs[0])).BeginningOfMinute()
 	}
 }
 
 // BeginningOfHour beginning of hour
 func BeginningOfHour(locs ...*time.Location) time.Time {
 	if len(locs) == 0 {
-		return With(time.Now()).BeginningOfHour()
+		return With(DefaultClock().Now()).BeginningOfHour()
 	} else {
-		return With(time.Now().In(locs[0])).BeginningOfHour()
+		return With(DefaultClock().Now().In(locs[0])).BeginningOfHour()
 	}
 }
 
 // BeginningOfDay beginning of day
 func BeginningOfDay(locs ...*time.Location) time.Time {
 	if len(locs) == 0 {
-		return With(time.Now()).BeginningOfDay()
+		return With(DefaultClock().Now()).BeginningOfDay()
 	} else {
-		return With(time.Now().In(locs[0])).BeginningOfDay()
+		return With(DefaultClock().Now().In(locs[0])).BeginningOfDay()
 	}
 }
 
 // BeginningOfWeek beginning of week
 func BeginningOfWeek(locs ...*time.Location) time.Time {
 	if len(locs) == 0 {
-		return With(time.Now()).BeginningOfWeek()
+		return With(DefaultClock().Now()).BeginningOfWeek()
 	} else {
-		return With(time.Now().In(locs[0])).BeginningOfWeek()
+		return With(DefaultClock().Now().In(locs[0])).BeginningOfWeek()
 	}
 }
 
 // BeginningOfMonth beginning of month
 func BeginningOfMonth(locs ...*time.Location) time.Time {
 	if len(locs) == 0 {
-		return With(time.Now()).BeginningOfMonth()
+		return With(DefaultClock().Now()).BeginningOfMonth()
 	} else {
-		return With(time.Now().In(locs[0])).BeginningOfMonth()
+		return With(DefaultClock().Now().In(locs[0])).BeginningOfMonth()
 	}
 }
 
 // BeginningOfQuarter beginning of quarter
 func BeginningOfQuarter(locs ...*time.Location) time.Time {
 	if len(locs) == 0 {
-		return With(time.Now()).BeginningOfQuarter()
+		return With(DefaultClock().Now()).BeginningOfQuarter()
 	} else {
-		return With(time.Now().In(locs[0])).BeginningOfQuarter()
+		return With(DefaultClock().Now().In(locs[0])).BeginningOfQuarter()
 	}
 }
 
 // BeginningOfYear beginning of year
 func BeginningOfYear(locs ...*time.Location) time.Time {
 	if len(locs) == 0 {
-		return With(time.Now()).BeginningOfYear()
+		return With(DefaultClock().Now()).BeginningOfYear()
 	} else {
-		return With(time.Now().In(locs[0])).BeginningOfYear()
+		return With(DefaultClock().Now().In(locs[0])).BeginningOfYear()
 	}
 }
 
 // EndOfMinute end of minute
 func EndOfMinute(locs ...*time.Location) time.Time {
 	if len(locs) == 0 {
-		return With(time.Now()).EndOfMinute()
+		return With(DefaultClock().Now()).EndOfMinute()
 	} else {
-		return With(time.Now().In(locs[0])).EndOfMinute()
+		return With(DefaultClock().Now().In(locs[0])).EndOfMinute()
 	}
 }
 
 // EndOfHour end of hour
 func EndOfHour(locs ...*time.Location) time.Time {
 	if len(locs) == 0 {
-		return With(time.Now()).EndOfHour()
+		return With(DefaultClock().Now()).EndOfHour()
 	} else {
-		return With(time.Now().In(locs[0])).EndOfHour()
+		return With(DefaultClock().Now().In(locs[0])).EndOfHour()
 	}
 }
 
 // EndOfDay end of day
 func EndOfDay(locs ...*time.Location) time.Time {
 	if len(locs) == 0 {
-		return With(time.Now()).EndOfDay()
+		return With(DefaultClock().Now()).EndOfDay()
 	} else {
-		return With(time.Now().In(locs[0])).EndOfDay()
+		return With(DefaultClock().Now().In(locs[0])).EndOfDay()
 	}
 }
 
 // EndOfWeek end of week
 func EndOfWeek(locs ...*time.Location) time.Time {
 	if len(locs) == 0 {
-		return With(time.Now()).EndOfWeek()
+		return With(DefaultClock().Now()).EndOfWeek()
 	} else {
-		return With(time.Now().In(locs[0])).EndOfWeek()
+		return With(DefaultClock().Now().In(locs[0])).EndOfWeek()
 	}
 }
 
 // EndOfMonth end of month
 func EndOfMonth(locs ...*time.Location) time.Time {
 	if len(locs) == 0 {
-		return With(time.Now()).EndOfMonth()
+		return With(DefaultClock().Now()).EndOfMonth()
 	} else {
-		return With(time.Now().In(locs[0])).EndOfMonth()
+		return With(DefaultClock().Now().In(locs[0])).EndOfMonth()
 	}
 }
 
 // EndOfQuarter end of quarter
 func EndOfQuarter(locs ...*time.Location) time.Time {
 	if len(locs) == 0 {
-		return With(time.Now()).EndOfQuarter()
+		return With(DefaultClock().Now()).EndOfQuarter()
 	} else {
-		return With(time.Now().In(locs[0])).EndOfQuarter()
+		return With(DefaultClock().Now().In(locs[0])).EndOfQuarter()
 	}
 }
 
 // EndOfYear end of year
 func EndOfYear(locs ...*time.Location) time.Time {
 	if len(locs) == 0 {
-		return With(time.Now()).EndOfYear()
+		return With(DefaultClock().Now()).EndOfYear()
 	} else {
-		return With(time.Now().In(locs[0])).EndOfYear()
+		return With(DefaultClock().Now().In(locs[0])).EndOfYear()
 	}
 }
 
 // Monday monday
 func Monday(locs ...*time.Location) time.Time {
 	if len(locs) == 0 {
-		return With(time.Now()).Monday()
+		return With(DefaultClock().Now()).Monday()
 	} else {
-		return With(time.Now().In(locs[0])).Monday()
+		return With(DefaultClock().Now().In(locs[0])).Monday()
 	}
 }
 
 // Sunday sunday
 func Sunday(locs ...*time.Location) time.Time {
 	if len(locs) == 0 {
-		return With(time.Now()).Sunday()
+		return With(DefaultClock().Now()).Sunday()
 	} else {
-		return With(time.Now().In(locs[0])).Sunday()
+		return With(DefaultClock().Now().In(locs[0])).Sunday()
 	}
 }
 
 // EndOfSunday end of sunday
 func EndOfSunday(locs ...*time.Location) time.Time {
 	if len(locs) == 0 {
-		return With(time.Now()).EndOfSunday()
+		return With(DefaultClock().Now()).EndOfSunday()
 	} else {
-		return With(time.Now().In(locs[0])).EndOfSunday()
+		return With(DefaultClock().Now().In(locs[0])).EndOfSunday()
 	}
 }
 
 // Parse parse string to time
 func Parse(strs ...string) (time.Time, error) {
-	return With(time.Now()).Parse(strs...)
+	return With(DefaultClock().Now()).Parse(strs...)
 }
 
 // ParseInLocation parse string to time in location
 func ParseInLocation(loc *time.Location, strs ...string) (time.Time, error) {
-	return With(time.Now().In(loc)).Parse(strs...)
+	return With(DefaultClock().Now().In(loc)).Parse(strs...)
 }
 
 // MustParse must parse string to time or will panic
 func MustParse(strs ...string) time.Time {
-	return With(time.Now()).MustParse(strs...)
+	return With(DefaultClock().Now()).MustParse(strs...)
 }
 
 // MustParseInLocation must parse string to time in location or will panic
 func MustParseInLocation(loc *time.Location, strs ...string) time.Time {
-	return With(time.Now().In(loc)).MustParse(strs...)
+	return With(DefaultClock().Now().In(loc)).MustParse(strs...)
 }
 
 // TimeBetween check now between the begin, end time or not
 func TimeBetween(time1, time2 string) bool {
-	return With(time.Now()).TimeBetween(time1, time2)
+	return With(DefaultClock().Now()).TimeBetween(time1, time2)
 }
 func TimeBetweenInLocation(loc *time.Location, time1, time2 string) bool {
-	return With(time.Now().In(loc)).TimeBetween(time1, time2)
+	return With(DefaultClock().Now().In(loc)).TimeBetween(time1, time2)
 }
 func TimestampToString(n int64, layouts ...string) string {
 	if n == 0 {
@@ -348,6 +348,20 @@ func TestConfig(t *testing.T) {
 	}
 }
 
+func TestDefaultClock(t *testing.T) {
+	assert := assertT(t)
+	defer SetDefaultClock(nil)
+	clock := NewFakeClock(time.Date(2013, 11, 18, 17, 51, 49, 123456789, time.UTC))
+	SetDefaultClock(clock)
+
+	assert(BeginningOfDay(time.UTC), "2013-11-18 00:00:00", "BeginningOfDay on DefaultClock")
+	assert(EndOfMonth(time.UTC), "2013-11-30 23:59:59.999999999", "EndOfMonth on DefaultClock")
+	assert(MustParseInLocation(time.UTC, "10:20"), "2013-11-18 10:20:00", "Parse time of day on DefaultClock")
+	if now := DefaultScheduler.now(); !now.Equal(clock.Now()) {
+		t.Errorf("DefaultScheduler time = %v; want the replaced DefaultClock at %v", now, clock.Now())
+	}
+}
+
 func Example() {
 	time.Now() // 2013-11-18 17:51:49.123456789 Mon
 
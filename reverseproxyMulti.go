@@ -0,0 +1,411 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrNoUpstream is passed to the ErrorHandler of a MultiHostReverseProxy
+// when it has no target to send a request to.
+var ErrNoUpstream = errors.New("utils: no upstream target")
+
+// Upstream is a target of a MultiHostReverseProxy.
+type Upstream struct {
+	URL *url.URL
+
+	weight int64 // for WeightedRoundRobin
+	active int64 // requests in flight
+}
+
+// Weight returns the weight of u for WeightedRoundRobin, 1 unless set with
+// MultiHostReverseProxy.SetWeight.
+func (u *Upstream) Weight() int {
+	return int(atomic.LoadInt64(&u.weight))
+}
+
+// Active returns the number of requests to u in flight.
+func (u *Upstream) Active() int {
+	return int(atomic.LoadInt64(&u.active))
+}
+
+// BalancePolicy picks the target of each request of a
+// MultiHostReverseProxy.
+type BalancePolicy interface {
+	// Pick returns one of upstreams, which is not empty, for req, or nil
+	// if none of them may take it. Pick is called concurrently.
+	Pick(req *http.Request, upstreams []*Upstream) *Upstream
+}
+
+// MultiHostReverseProxy is a ReverseProxy that spreads requests over a set
+// of targets, chosen for each request by a BalancePolicy. The targets can
+// be changed while the proxy is serving.
+type MultiHostReverseProxy struct {
+	*ReverseProxy
+
+	policy BalancePolicy
+
+	mu        sync.RWMutex
+	upstreams []*Upstream
+}
+
+// upstreamKey is the context key of the upstream picked for a request.
+type upstreamKey struct{}
+
+// NewMultiHostReverseProxy returns a proxy that routes each request to one
+// of targets, like NewSingleHostReverseProxy does to its target. A nil
+// policy means RoundRobin.
+func NewMultiHostReverseProxy(targets []*url.URL, policy BalancePolicy) *MultiHostReverseProxy {
+	if policy == nil {
+		policy = RoundRobin()
+	}
+	p := &MultiHostReverseProxy{policy: policy}
+	p.SetTargets(targets)
+	director := func(req *http.Request) {
+		up, _ := req.Context().Value(upstreamKey{}).(*Upstream)
+		if up == nil {
+			// Served by the embedded ReverseProxy directly.
+			up = p.pick(req)
+		}
+		if up != nil {
+			rewriteRequestURL(req, up.URL)
+		}
+	}
+	p.ReverseProxy = &ReverseProxy{Director: director}
+	return p
+}
+
+// SetTargets replaces the targets of the proxy. Requests in flight are not
+// interrupted. Targets that were already set keep their weight. Nil
+// targets are ignored.
+func (p *MultiHostReverseProxy) SetTargets(targets []*url.URL) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old := make(map[string]*Upstream, len(p.upstreams))
+	for _, u := range p.upstreams {
+		old[u.URL.String()] = u
+	}
+	ups := make([]*Upstream, 0, len(targets))
+	for _, target := range targets {
+		if target == nil {
+			continue
+		}
+		u := old[target.String()]
+		if u == nil {
+			u = &Upstream{URL: target, weight: 1}
+		}
+		ups = append(ups, u)
+	}
+	p.upstreams = ups
+}
+
+// Targets returns the targets of the proxy.
+func (p *MultiHostReverseProxy) Targets() []*url.URL {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	targets := make([]*url.URL, len(p.upstreams))
+	for i, u := range p.upstreams {
+		targets[i] = u.URL
+	}
+	return targets
+}
+
+// Upstreams returns the targets of the proxy with their weights and the
+// requests in flight.
+func (p *MultiHostReverseProxy) Upstreams() []*Upstream {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]*Upstream(nil), p.upstreams...)
+}
+
+// SetWeight sets the weight of target, as passed to SetTargets, for
+// WeightedRoundRobin. A weight of 0 takes the target out of rotation. It
+// reports whether target is one of the targets of the proxy.
+func (p *MultiHostReverseProxy) SetWeight(target string, weight int) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, u := range p.upstreams {
+		if u.URL.String() == target {
+			atomic.StoreInt64(&u.weight, int64(weight))
+			return true
+		}
+	}
+	return false
+}
+
+func (p *MultiHostReverseProxy) pick(req *http.Request) *Upstream {
+	p.mu.RLock()
+	ups := p.upstreams
+	p.mu.RUnlock()
+	if len(ups) == 0 {
+		return nil
+	}
+	return p.policy.Pick(req, ups)
+}
+
+// ServeHTTP sends req to the target picked by the policy, or fails it with
+// ErrNoUpstream if there is none.
+func (p *MultiHostReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	p.ServeHTTPContext(req.Context(), rw, req)
+}
+
+// ServeHTTPContext is like ServeHTTP with the given context for the
+// request to the target.
+func (p *MultiHostReverseProxy) ServeHTTPContext(ctx context.Context, rw http.ResponseWriter, req *http.Request) {
+	up := p.pick(req)
+	if up == nil {
+		p.getErrorHandler()(rw, req, ErrNoUpstream)
+		return
+	}
+	atomic.AddInt64(&up.active, 1)
+	defer atomic.AddInt64(&up.active, -1)
+	p.ReverseProxy.ServeHTTPContext(context.WithValue(ctx, upstreamKey{}, up), rw, req)
+}
+
+// RoundRobin returns a policy that sends requests to the targets in turn.
+func RoundRobin() BalancePolicy {
+	return &roundRobin{}
+}
+
+type roundRobin struct {
+	next uint64
+}
+
+func (r *roundRobin) Pick(req *http.Request, ups []*Upstream) *Upstream {
+	n := atomic.AddUint64(&r.next, 1) - 1
+	return ups[n%uint64(len(ups))]
+}
+
+// WeightedRoundRobin returns a policy that sends requests to the targets in
+// proportion to their weights, interleaved as evenly as possible: with
+// weights 2 and 1, the targets get requests in the order a, b, a. Weights
+// are set with MultiHostReverseProxy.SetWeight.
+func WeightedRoundRobin() BalancePolicy {
+	return &weightedRoundRobin{current: make(map[*Upstream]int)}
+}
+
+type weightedRoundRobin struct {
+	mu      sync.Mutex
+	current map[*Upstream]int
+}
+
+// Pick implements the smooth weighted round-robin of nginx.
+func (r *weightedRoundRobin) Pick(req *http.Request, ups []*Upstream) *Upstream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var best *Upstream
+	total := 0
+	for _, u := range ups {
+		w := u.Weight()
+		if w <= 0 {
+			continue
+		}
+		r.current[u] += w
+		total += w
+		if best == nil || r.current[u] > r.current[best] {
+			best = u
+		}
+	}
+	if best != nil {
+		r.current[best] -= total
+	}
+	if len(r.current) > len(ups) {
+		// Forget targets that were removed.
+		keep := make(map[*Upstream]bool, len(ups))
+		for _, u := range ups {
+			keep[u] = true
+		}
+		for u := range r.current {
+			if !keep[u] {
+				delete(r.current, u)
+			}
+		}
+	}
+	return best
+}
+
+// LeastConnections returns a policy that sends each request to the target
+// with the fewest requests in flight. Ties are broken in turn.
+func LeastConnections() BalancePolicy {
+	return &leastConnections{}
+}
+
+type leastConnections struct {
+	next uint64
+}
+
+func (l *leastConnections) Pick(req *http.Request, ups []*Upstream) *Upstream {
+	start := atomic.AddUint64(&l.next, 1) - 1
+	var best *Upstream
+	for i := range ups {
+		u := ups[(start+uint64(i))%uint64(len(ups))]
+		if best == nil || u.Active() < best.Active() {
+			best = u
+		}
+	}
+	return best
+}
+
+// RandomTwoChoices returns a policy that picks two targets at random and
+// sends the request to the one with fewer requests in flight. It is nearly
+// as even as LeastConnections without looking at every target.
+func RandomTwoChoices() BalancePolicy {
+	return randomTwoChoices{}
+}
+
+type randomTwoChoices struct{}
+
+func (randomTwoChoices) Pick(req *http.Request, ups []*Upstream) *Upstream {
+	if len(ups) == 1 {
+		return ups[0]
+	}
+	i := rand.Intn(len(ups))
+	j := rand.Intn(len(ups) - 1)
+	if j >= i {
+		j++
+	}
+	if ups[j].Active() < ups[i].Active() {
+		return ups[j]
+	}
+	return ups[i]
+}
+
+// HashKey returns the key a ConsistentHash policy routes req by, or "" if
+// req has none.
+type HashKey func(req *http.Request) string
+
+// HashHeader keys requests by the value of the named header.
+func HashHeader(name string) HashKey {
+	return func(req *http.Request) string {
+		return req.Header.Get(name)
+	}
+}
+
+// HashCookie keys requests by the value of the named cookie.
+func HashCookie(name string) HashKey {
+	return func(req *http.Request) string {
+		c, err := req.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return c.Value
+	}
+}
+
+// HashClientIP keys requests by the IP address of the client. Behind
+// another proxy, use HashHeader with the header carrying the client
+// address instead.
+func HashClientIP() HashKey {
+	return func(req *http.Request) string {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return req.RemoteAddr
+		}
+		return host
+	}
+}
+
+// hashReplicas is the number of points of each target on the hash ring.
+const hashReplicas = 160
+
+// ConsistentHash returns a policy that sends the requests with the same
+// key to the same target. When targets are added or removed, only the keys
+// of the targets removed, or of about their share for the targets added,
+// move. Requests without a key are sent to the targets in turn.
+func ConsistentHash(key HashKey) BalancePolicy {
+	return &consistentHash{key: key}
+}
+
+type consistentHash struct {
+	key      HashKey
+	fallback roundRobin
+
+	ring atomic.Pointer[hashRing] // the last ring built
+	mu   sync.Mutex               // held while building a ring
+}
+
+// hashRing is the hash ring of a set of targets.
+type hashRing struct {
+	ups    []*Upstream // the targets the ring was built for
+	points []ringPoint // by hash
+}
+
+type ringPoint struct {
+	hash uint64
+	up   *Upstream
+}
+
+func (c *consistentHash) Pick(req *http.Request, ups []*Upstream) *Upstream {
+	k := c.key(req)
+	if k == "" {
+		return c.fallback.Pick(req, ups)
+	}
+	points := c.ringFor(ups).points
+	h := hashString(k)
+	i := sort.Search(len(points), func(i int) bool { return points[i].hash >= h })
+	if i == len(points) {
+		i = 0
+	}
+	return points[i].up
+}
+
+// ringFor returns the hash ring of ups, building it if the targets
+// changed. Only building takes the lock.
+func (c *consistentHash) ringFor(ups []*Upstream) *hashRing {
+	if r := c.ring.Load(); r != nil && r.built(ups) {
+		return r
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if r := c.ring.Load(); r != nil && r.built(ups) {
+		return r
+	}
+
+	points := make([]ringPoint, 0, len(ups)*hashReplicas)
+	for _, u := range ups {
+		name := u.URL.String()
+		for r := 0; r < hashReplicas; r++ {
+			points = append(points, ringPoint{hashString(name + "#" + strconv.Itoa(r)), u})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	r := &hashRing{ups: ups, points: points}
+	c.ring.Store(r)
+	return r
+}
+
+// built reports whether r was built for ups.
+func (r *hashRing) built(ups []*Upstream) bool {
+	if len(ups) != len(r.ups) {
+		return false
+	}
+	for i := range ups {
+		if ups[i] != r.ups[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// FNV leaves the high bits of short, similar strings such as the
+	// points of a target alike; mix them to spread the points over the
+	// ring (the finalizer of MurmurHash3).
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
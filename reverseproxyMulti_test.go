@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// startBackends starts n backends that answer with their index.
+func startBackends(t *testing.T, n int) []*url.URL {
+	var targets []*url.URL
+	for i := 0; i < n; i++ {
+		name := strconv.Itoa(i)
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(backend.Close)
+		u, err := url.Parse(backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		targets = append(targets, u)
+	}
+	return targets
+}
+
+// proxyGet sends a request through p and returns the body of the response.
+func proxyGet(t *testing.T, p http.Handler, setup func(*http.Request)) string {
+	req := httptest.NewRequest("GET", "/", nil)
+	if setup != nil {
+		setup(req)
+	}
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status = %d; want 200", rw.Code)
+	}
+	return rw.Body.String()
+}
+
+func TestMultiHostReverseProxyRoundRobin(t *testing.T) {
+	p := NewMultiHostReverseProxy(startBackends(t, 3), RoundRobin())
+	var got []string
+	for i := 0; i < 6; i++ {
+		got = append(got, proxyGet(t, p, nil))
+	}
+	equal(t, "0 1 2 0 1 2", strings.Join(got, " "))
+	for _, u := range p.Upstreams() {
+		if u.Active() != 0 {
+			t.Errorf("%v has %d requests in flight after all finished", u.URL, u.Active())
+		}
+	}
+}
+
+func TestMultiHostReverseProxyWeighted(t *testing.T) {
+	targets := startBackends(t, 3)
+	p := NewMultiHostReverseProxy(targets, WeightedRoundRobin())
+	p.SetWeight(targets[0].String(), 3)
+	p.SetWeight(targets[2].String(), 0)
+	if p.SetWeight("http://unknown", 1) {
+		t.Error("SetWeight of an unknown target returned true")
+	}
+	var got []string
+	for i := 0; i < 8; i++ {
+		got = append(got, proxyGet(t, p, nil))
+	}
+	equal(t, "0 0 1 0 0 0 1 0", strings.Join(got, " "))
+}
+
+func TestMultiHostReverseProxyLeastConnections(t *testing.T) {
+	ups := []*Upstream{{active: 3}, {active: 1}, {active: 2}}
+	lc := LeastConnections()
+	for i := 0; i < 3; i++ {
+		if u := lc.Pick(nil, ups); u != ups[1] {
+			t.Fatalf("picked the upstream with %d requests in flight; want 1", u.Active())
+		}
+	}
+
+	// Random two choices never picks the busiest of two.
+	two := RandomTwoChoices()
+	for i := 0; i < 20; i++ {
+		if u := two.Pick(nil, ups[:2]); u != ups[1] {
+			t.Fatalf("picked the upstream with %d requests in flight; want 1", u.Active())
+		}
+	}
+}
+
+func TestMultiHostReverseProxyConsistentHash(t *testing.T) {
+	targets := startBackends(t, 3)
+	p := NewMultiHostReverseProxy(targets, ConsistentHash(HashHeader("X-User")))
+	user := func(id string) func(*http.Request) {
+		return func(req *http.Request) { req.Header.Set("X-User", id) }
+	}
+
+	before := make(map[string]string)
+	count := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		id := strconv.Itoa(i)
+		before[id] = proxyGet(t, p, user(id))
+		count[before[id]]++
+		if again := proxyGet(t, p, user(id)); again != before[id] {
+			t.Fatalf("user %s went to %s, then %s", id, before[id], again)
+		}
+	}
+	for _, name := range []string{"0", "1", "2"} {
+		if count[name] < 50 {
+			t.Errorf("backend %s got %d of 300 users", name, count[name])
+		}
+	}
+
+	// Only the users of the removed target move.
+	p.SetTargets([]*url.URL{targets[0], targets[2]})
+	for id, was := range before {
+		if now := proxyGet(t, p, user(id)); was != "1" && now != was {
+			t.Errorf("user %s moved from %s to %s", id, was, now)
+		}
+	}
+
+	cookie := ConsistentHash(HashCookie("session"))
+	ups := p.Upstreams()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	if a, b := cookie.Pick(req, ups), cookie.Pick(req, ups); a != b {
+		t.Errorf("same cookie went to %v, then %v", a.URL, b.URL)
+	}
+	ip := ConsistentHash(HashClientIP())
+	req.RemoteAddr = "192.0.2.1:1234"
+	a := ip.Pick(req, ups)
+	req.RemoteAddr = "192.0.2.1:5678"
+	if b := ip.Pick(req, ups); a != b {
+		t.Errorf("same client IP went to %v, then %v", a.URL, b.URL)
+	}
+}
+
+func TestMultiHostReverseProxySetTargets(t *testing.T) {
+	targets := startBackends(t, 2)
+	p := NewMultiHostReverseProxy(targets[:1], nil)
+	equal(t, "0", proxyGet(t, p, nil))
+
+	p.SetTargets([]*url.URL{nil, targets[1], nil})
+	equal(t, "1", proxyGet(t, p, nil))
+	equal(t, []*url.URL{targets[1]}, p.Targets())
+
+	p.SetTargets(nil)
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusBadGateway {
+		t.Errorf("status with no targets = %d; want %d", rw.Code, http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,387 @@
+package utils
+
+import (
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fieldSegment is a run of values of a schedule field: lo through hi every
+// step. A single value has lo == hi.
+type fieldSegment struct {
+	lo, hi, step uint
+}
+
+// fieldValues returns the values set in b within r, in order.
+func fieldValues(b uint64, r bounds) []uint {
+	var vs []uint
+	for v := r.min; v <= r.max; v++ {
+		if b&(1<<v) > 0 {
+			vs = append(vs, v)
+		}
+	}
+	return vs
+}
+
+// starStep returns the step of a field set by "*" or "*/step", or 0 if b
+// is not such a field.
+func starStep(b uint64, r bounds) uint {
+	if b&starBit == 0 {
+		return 0
+	}
+	for step := uint(1); step <= r.max-r.min+1; step++ {
+		if getBits(r.min, r.max, step) == b&^starBit {
+			return step
+		}
+	}
+	return 0
+}
+
+// fullStep is like starStep, but also returns the step of a stepped range
+// over the whole field, such as "1-31/2" or "1/2" for days.
+func fullStep(b uint64, r bounds) uint {
+	if step := starStep(b, r); step > 0 {
+		return step
+	}
+	segs := fieldSegments(b, r)
+	if len(segs) == 1 && segs[0].lo == r.min && segs[0].step > 1 && segs[0].hi+segs[0].step > r.max {
+		return segs[0].step
+	}
+	return 0
+}
+
+// ordinal returns n as an English ordinal such as "2nd" or "11th".
+func ordinal(n uint) string {
+	suffix := "th"
+	switch {
+	case n%100 >= 11 && n%100 <= 13:
+	case n%10 == 1:
+		suffix = "st"
+	case n%10 == 2:
+		suffix = "nd"
+	case n%10 == 3:
+		suffix = "rd"
+	}
+	return strconv.Itoa(int(n)) + suffix
+}
+
+// fieldSegments splits the values of b into segments: a single stepped
+// range if the values are evenly spaced, else runs of consecutive values.
+func fieldSegments(b uint64, r bounds) []fieldSegment {
+	vs := fieldValues(b, r)
+	if len(vs) >= 3 && vs[1]-vs[0] > 1 {
+		step, even := vs[1]-vs[0], true
+		for i := 2; i < len(vs) && even; i++ {
+			even = vs[i]-vs[i-1] == step
+		}
+		if even {
+			return []fieldSegment{{vs[0], vs[len(vs)-1], step}}
+		}
+	}
+
+	var segs []fieldSegment
+	for i := 0; i < len(vs); {
+		j := i
+		for j+1 < len(vs) && vs[j+1] == vs[j]+1 {
+			j++
+		}
+		segs = append(segs, fieldSegment{vs[i], vs[j], 1})
+		i = j + 1
+	}
+	return segs
+}
+
+// String returns the schedule as a canonical six-field spec, which parses
+// back to the same schedule. Descriptors such as @daily are expanded.
+func (s *Schedule) String() string {
+	fields := []string{
+		fieldString(s.Second, seconds, nil),
+		fieldString(s.Minute, minutes, nil),
+		fieldString(s.Hour, hours, nil),
+		fieldString(s.Day, days, s.dayModifiers()),
+		fieldString(s.Month, months, nil),
+		fieldString(s.Week, weeks, s.weekModifiers()),
+	}
+	spec := strings.Join(fields, " ")
+	if s.Location != nil {
+		spec = "CRON_TZ=" + s.Location.String() + " " + spec
+	}
+	return spec
+}
+
+func fieldString(b uint64, r bounds, modifiers []string) string {
+	var parts []string
+	if b&starBit > 0 {
+		// Find the "*" or "*/step" the field was built from; any values
+		// beyond it were listed next to it.
+		for step := uint(1); step <= r.max-r.min+1; step++ {
+			if star := getBits(r.min, r.max, step); star&^b == 0 {
+				if step == 1 {
+					parts = append(parts, "*")
+				} else {
+					parts = append(parts, "*/"+strconv.Itoa(int(step)))
+				}
+				b &^= star
+				break
+			}
+		}
+	}
+	if b&^starBit != 0 {
+		for _, seg := range fieldSegments(b, r) {
+			switch {
+			case seg.lo == seg.hi:
+				parts = append(parts, strconv.Itoa(int(seg.lo)))
+			case seg.step == 1:
+				parts = append(parts, strconv.Itoa(int(seg.lo))+"-"+strconv.Itoa(int(seg.hi)))
+			default:
+				parts = append(parts, strconv.Itoa(int(seg.lo))+"-"+strconv.Itoa(int(seg.hi))+"/"+strconv.Itoa(int(seg.step)))
+			}
+		}
+	}
+	return strings.Join(append(parts, modifiers...), ",")
+}
+
+// dayModifiers returns the L and W modifiers of the day of month field.
+func (s *Schedule) dayModifiers() []string {
+	var mods []string
+	for n := uint(0); n <= 30; n++ {
+		if s.lastDays&(1<<n) > 0 {
+			if n == 0 {
+				mods = append(mods, "L")
+			} else {
+				mods = append(mods, "L-"+strconv.Itoa(int(n)))
+			}
+		}
+	}
+	if s.lastWeekday {
+		mods = append(mods, "LW")
+	}
+	for _, d := range fieldValues(s.nearWeekday, days) {
+		mods = append(mods, strconv.Itoa(int(d))+"W")
+	}
+	return mods
+}
+
+// weekModifiers returns the # and L modifiers of the day of week field.
+func (s *Schedule) weekModifiers() []string {
+	var mods []string
+	for w := uint(0); w <= 6; w++ {
+		for n := uint(1); n <= 5; n++ {
+			if s.nthWeekday&(1<<(8*w+n)) > 0 {
+				mods = append(mods, strconv.Itoa(int(w))+"#"+strconv.Itoa(int(n)))
+			}
+		}
+		if s.lastWeek&(1<<w) > 0 {
+			mods = append(mods, strconv.Itoa(int(w))+"L")
+		}
+	}
+	return mods
+}
+
+// NextN returns the next n run times after from, fewer if the schedule
+// ends.
+func (s *Schedule) NextN(from time.Time, n int) []time.Time {
+	var out []time.Time
+	for t := from; len(out) < n; {
+		if t = s.Next(t); t.IsZero() {
+			break
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// Describe returns the schedule in English, e.g. "at second 0, minute 2,
+// every 3 hours from 8 through 20" for the spec "0 2 8-20/3 * * *". A step
+// over a whole field is nested under the field below it, as in "every 15
+// seconds of every 2nd minute" for "*/15 */2 * * * *".
+func (s *Schedule) Describe() string {
+	// Time fields, from the smallest unit up: a "*" field is only
+	// mentioned below a restricted one.
+	timeFields := []struct {
+		b            uint64
+		r            bounds
+		unit, plural string
+	}{
+		{s.Second, seconds, "second", "seconds"},
+		{s.Minute, minutes, "minute", "minutes"},
+		{s.Hour, hours, "hour", "hours"},
+	}
+	// A field below one that is itself a step, like "every 15 seconds",
+	// is nested: "of minute 0", "of every 2nd minute".
+	desc, nest := "", false
+	for i, f := range timeFields {
+		step := fullStep(f.b, f.r)
+		part := describeField(f.b, f.r, f.unit, f.plural, nil)
+		if step == 1 {
+			restricted := false
+			for _, g := range timeFields[i+1:] {
+				restricted = restricted || fullStep(g.b, g.r) != 1
+			}
+			if !restricted {
+				continue
+			}
+			part = "every " + f.unit
+		}
+		switch {
+		case desc == "":
+			desc = part
+		case step > 1:
+			desc += " of every " + ordinal(step) + " " + f.unit
+		case nest:
+			desc += " of " + part
+		default:
+			desc += ", " + part
+		}
+		nest = step > 0
+	}
+	switch {
+	case desc == "":
+		desc = "every second"
+	case !strings.HasPrefix(desc, "every "):
+		// "every 5 seconds" reads better without "at".
+		desc = "at " + desc
+	}
+
+	dom, dow := s.describeDays(), s.describeWeekdays()
+	switch {
+	case dom != "" && dow != "" && s.Day&starBit == 0 && s.Week&starBit == 0:
+		desc += ", " + dom + " or " + dow
+	case dom != "" && dow != "":
+		desc += ", " + dom + " and " + dow
+	case dom != "":
+		desc += ", " + dom
+	case dow != "":
+		desc += ", " + dow
+	}
+	switch step := fullStep(s.Month, months); {
+	case step > 1:
+		desc += ", every " + strconv.Itoa(int(step)) + " months"
+	case step == 0:
+		desc += ", in " + describeField(s.Month, months, "month", "months", func(v uint) string { return time.Month(v).String() })
+	}
+	if s.Location != nil {
+		desc += ", " + s.Location.String() + " time"
+	}
+	return desc
+}
+
+// describeDays describes the day of month field, or returns "" if it is
+// "*".
+func (s *Schedule) describeDays() string {
+	var items []string
+	if step := starStep(s.Day, days); step == 1 {
+		if s.lastDays == 0 && !s.lastWeekday && s.nearWeekday == 0 {
+			return ""
+		}
+	} else if s.Day&^starBit != 0 {
+		items = append(items, describeField(s.Day, days, "day", "days", nil)+" of the month")
+	}
+	for n := uint(0); n <= 30; n++ {
+		if s.lastDays&(1<<n) == 0 {
+			continue
+		}
+		switch n {
+		case 0:
+			items = append(items, "the last day of the month")
+		case 1:
+			items = append(items, "1 day before the last day of the month")
+		default:
+			items = append(items, strconv.Itoa(int(n))+" days before the last day of the month")
+		}
+	}
+	if s.lastWeekday {
+		items = append(items, "the last weekday of the month")
+	}
+	for _, d := range fieldValues(s.nearWeekday, days) {
+		items = append(items, "the weekday nearest day "+strconv.Itoa(int(d))+" of the month")
+	}
+	return onList(items)
+}
+
+var ordinals = []string{"", "first", "second", "third", "fourth", "fifth"}
+
+// describeWeekdays describes the day of week field, or returns "" if it is
+// "*".
+func (s *Schedule) describeWeekdays() string {
+	var items []string
+	if step := starStep(s.Week, weeks); step == 1 {
+		if s.nthWeekday == 0 && s.lastWeek == 0 {
+			return ""
+		}
+	} else if s.Week&^starBit != 0 {
+		item := describeField(s.Week, weeks, "day", "days", func(v uint) string { return time.Weekday(v).String() })
+		if fullStep(s.Week, weeks) > 1 {
+			item += " of the week"
+		}
+		items = append(items, item)
+	}
+	for w := uint(0); w <= 6; w++ {
+		for n := uint(1); n <= 5; n++ {
+			if s.nthWeekday&(1<<(8*w+n)) > 0 {
+				items = append(items, "the "+ordinals[n]+" "+time.Weekday(w).String()+" of the month")
+			}
+		}
+		if s.lastWeek&(1<<w) > 0 {
+			items = append(items, "the last "+time.Weekday(w).String()+" of the month")
+		}
+	}
+	return onList(items)
+}
+
+// onList joins the days a schedule runs on as in "on a or b"; a leading
+// step reads "every 2 days of the month or on ...".
+func onList(items []string) string {
+	if len(items) > 0 && strings.HasPrefix(items[0], "every ") {
+		if len(items) == 1 {
+			return items[0]
+		}
+		return items[0] + " or on " + joinList(items[1:], "or")
+	}
+	return "on " + joinList(items, "or")
+}
+
+// describeField describes the values of a field. Fields with names (months
+// and weekdays) pass name; their values are not prefixed with the unit.
+func describeField(b uint64, r bounds, unit, plural string, name func(uint) string) string {
+	prefix := name == nil
+	if name == nil {
+		name = func(v uint) string { return strconv.Itoa(int(v)) }
+	}
+	if step := fullStep(b, r); step > 1 {
+		return "every " + strconv.Itoa(int(step)) + " " + plural
+	}
+
+	segs := fieldSegments(b, r)
+	if len(segs) == 1 && segs[0].step > 1 {
+		seg := segs[0]
+		return "every " + strconv.Itoa(int(seg.step)) + " " + plural +
+			" from " + name(seg.lo) + " through " + name(seg.hi)
+	}
+
+	var items []string
+	for _, seg := range segs {
+		if seg.lo == seg.hi {
+			items = append(items, name(seg.lo))
+		} else {
+			items = append(items, name(seg.lo)+" through "+name(seg.hi))
+		}
+	}
+	list := joinList(items, "and")
+	switch {
+	case !prefix:
+		return list
+	case bits.OnesCount64(b&^starBit) == 1:
+		return unit + " " + list
+	}
+	return plural + " " + list
+}
+
+// joinList joins items as in "a, b and c".
+func joinList(items []string, conj string) string {
+	if len(items) <= 1 {
+		return strings.Join(items, "")
+	}
+	return strings.Join(items[:len(items)-1], ", ") + " " + conj + " " + items[len(items)-1]
+}
@@ -0,0 +1,515 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Scheduler runs a set of named tasks on their schedules. Tasks may be
+// added and removed at any time, also while the scheduler is running.
+// Several schedulers can run side by side; the package-level task
+// functions use DefaultScheduler. Runs that come due late, e.g. after the
+// process was suspended, still run unless the task has a misfire policy;
+// see WithMisfire.
+type Scheduler struct {
+	mu      sync.Mutex
+	tasks   map[string]Tasker
+	states  map[string]*taskState // runs in progress, by task name
+	paused  map[string]bool       // names of paused tasks
+	changed chan struct{}         // wakes the run loop after tasks changed
+	slots   chan struct{}         // limits concurrent runs, nil for no limit
+	store   StateStore            // last run times, nil if not persisted
+	locker  Locker                // leases for occurrences, nil to run without
+	lockTTL time.Duration
+	clock   Clock // nil means DefaultClock
+	hooks   Hooks
+	events  chan Event
+
+	running bool
+	ctx     context.Context // done when the scheduler stops
+	cancel  context.CancelFunc
+	done    chan struct{}  // closed when the run loop exits
+	wg      sync.WaitGroup // in-flight task runs
+}
+
+// SchedulerOption configures a Scheduler.
+type SchedulerOption func(*Scheduler)
+
+// WithMaxConcurrency limits the number of task runs in progress at the same
+// time to n. Runs beyond the limit wait for a free slot. n <= 0 means no
+// limit, which is the default.
+func WithMaxConcurrency(n int) SchedulerOption {
+	return func(s *Scheduler) {
+		if n > 0 {
+			s.slots = make(chan struct{}, n)
+		} else {
+			s.slots = nil
+		}
+	}
+}
+
+// OverlapPolicy decides what happens when a task is due while its previous
+// run is still in progress.
+type OverlapPolicy int
+
+const (
+	// OverlapAllow starts the new run alongside the previous one.
+	OverlapAllow OverlapPolicy = iota
+	// OverlapSkip skips the new run.
+	OverlapSkip
+	// OverlapQueue starts the new run once the previous one finished.
+	// At most one run is queued; further runs are skipped.
+	OverlapQueue
+)
+
+func (p OverlapPolicy) String() string {
+	switch p {
+	case OverlapAllow:
+		return "allow"
+	case OverlapSkip:
+		return "skip"
+	case OverlapQueue:
+		return "queue"
+	}
+	return "unknown"
+}
+
+// overlapper is implemented by tasks with an overlap policy other than
+// OverlapAllow.
+type overlapper interface {
+	overlapPolicy() OverlapPolicy
+}
+
+// plannedRunner is implemented by tasks that record their executions. The
+// scheduler passes the planned time of the run and why it was delayed, if
+// it was.
+type plannedRunner interface {
+	runPlanned(ctx context.Context, planned time.Time, reason string) error
+}
+
+// skipRecorder is implemented by tasks that record skipped runs.
+type skipRecorder interface {
+	recordSkip(planned time.Time, reason string)
+}
+
+// taskState tracks the runs of one task.
+type taskState struct {
+	running   int
+	queued    bool
+	queuedAt  []time.Time // planned times of the queued run
+	queuedWhy string      // why the queued run is late, besides the queue
+	queuedDAG *dagRun     // DAG run of the queued run, if any
+}
+
+// NewScheduler creates an empty, stopped scheduler.
+func NewScheduler(opts ...SchedulerOption) *Scheduler {
+	s := &Scheduler{
+		tasks:   make(map[string]Tasker),
+		states:  make(map[string]*taskState),
+		paused:  make(map[string]bool),
+		changed: make(chan struct{}, 1),
+		events:  make(chan Event, EventBufferSize),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// now returns the local time of the scheduler's clock.
+func (s *Scheduler) now() time.Time {
+	return s.getClock().Now().Local()
+}
+
+// getClock returns the clock of the scheduler, DefaultClock unless it was
+// created WithClock.
+func (s *Scheduler) getClock() Clock {
+	if s.clock == nil {
+		return DefaultClock()
+	}
+	return s.clock
+}
+
+// clockSetter is implemented by tasks that take their time from the clock
+// of the scheduler they are added to.
+type clockSetter interface {
+	setClock(c Clock)
+}
+
+// AddTask registers t under name, replacing any task with the same name.
+// It returns an error wrapping ErrDependencyCycle if t depends on itself
+// through the tasks already registered.
+func (s *Scheduler) AddTask(name string, t Tasker) error {
+	s.mu.Lock()
+	if err := s.checkCycle(name, t); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if c, ok := t.(clockSetter); ok {
+		c.setClock(s.clock)
+	}
+	if a, ok := t.(intervalAligner); ok && s.locker != nil {
+		a.alignIntervals()
+	}
+	running, ctx := s.running, s.ctx
+	now := s.now()
+	if running {
+		t.SetNext(now)
+	}
+	s.tasks[name] = t
+	s.mu.Unlock()
+	if running {
+		s.scheduled(name, t, now)
+		s.catchUp(ctx, name, t, now)
+	}
+	s.notify()
+	return nil
+}
+
+// DeleteTask removes the task registered under name. A run that is already
+// in progress is not interrupted.
+func (s *Scheduler) DeleteTask(name string) {
+	s.mu.Lock()
+	_, ok := s.tasks[name]
+	delete(s.tasks, name)
+	delete(s.paused, name)
+	s.mu.Unlock()
+	if ok {
+		s.emit(Event{Kind: EventRemoved, Task: name, Time: s.now()})
+	}
+	s.notify()
+}
+
+// Task returns the task registered under name.
+func (s *Scheduler) Task(name string) (Tasker, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tasks[name]
+	return t, ok
+}
+
+// Tasks returns a copy of the registered tasks by name.
+func (s *Scheduler) Tasks() map[string]Tasker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := make(map[string]Tasker, len(s.tasks))
+	for k, v := range s.tasks {
+		m[k] = v
+	}
+	return m
+}
+
+// Start starts running the tasks in a background goroutine. The scheduler
+// runs until Stop is called or ctx is done. Start does nothing if the
+// scheduler is already running.
+func (s *Scheduler) Start(ctx context.Context) {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.ctx = ctx
+	s.done = make(chan struct{})
+	s.running = true
+
+	now := s.now()
+	tasks := make(map[string]Tasker, len(s.tasks))
+	for name, t := range s.tasks {
+		t.SetNext(now)
+		tasks[name] = t
+	}
+	s.mu.Unlock()
+
+	for name, t := range tasks {
+		s.scheduled(name, t, now)
+		s.catchUp(ctx, name, t, now)
+	}
+	go s.run(ctx, now)
+}
+
+// Stop stops the scheduler and waits for the task runs in progress to
+// finish.
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	cancel, done := s.cancel, s.done
+	s.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+	s.wg.Wait()
+}
+
+// Running reports whether the scheduler is running.
+func (s *Scheduler) Running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+// remove deletes the task registered under name if its schedule is over,
+// that is unless it was replaced by a task with runs left. Tasks are not
+// compared, as they need not be comparable.
+func (s *Scheduler) remove(name string) {
+	s.mu.Lock()
+	t, ok := s.tasks[name]
+	ok = ok && t.GetNext().IsZero()
+	if ok {
+		delete(s.tasks, name)
+	}
+	s.mu.Unlock()
+	if ok {
+		s.emit(Event{Kind: EventRemoved, Task: name, Time: s.now()})
+	}
+}
+
+// notify wakes the run loop without blocking; notifications coalesce.
+func (s *Scheduler) notify() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) run(ctx context.Context, now time.Time) {
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.cancel = nil
+		close(s.done)
+		s.mu.Unlock()
+	}()
+
+	for {
+		s.mu.Lock()
+		sortList := NewMapSorter(s.active())
+		s.mu.Unlock()
+		sortList.Sort()
+
+		var effective time.Time
+		if len(sortList.Vals) == 0 || sortList.Vals[0].GetNext().IsZero() {
+			// If there are no entries yet, just sleep - it still handles new entries
+			// and stop requests.
+			effective = now.AddDate(10, 0, 0)
+		} else {
+			effective = sortList.Vals[0].GetNext()
+		}
+
+		timer := s.getClock().NewTimer(effective.Sub(now))
+		select {
+		case now = <-timer.C():
+			now = now.Local()
+			// Run every entry whose next time was this effective time.
+			late := now.Sub(effective) > misfireThreshold
+			for i, e := range sortList.Vals {
+				if !e.GetNext().Equal(effective) {
+					break
+				}
+				e.SetPrev(effective)
+				if late && hasMisfirePolicy(e) {
+					// The clock jumped or the process was suspended.
+					s.misfired(ctx, sortList.Keys[i], e, effective, now, "clock jumped or process suspended")
+					e.SetNext(now)
+				} else {
+					s.runTask(ctx, sortList.Keys[i], e, effective, nil)
+					e.SetNext(effective)
+				}
+				if e.GetNext().IsZero() {
+					// The schedule is done, e.g. a one-shot At.
+					s.remove(sortList.Keys[i])
+				} else {
+					s.scheduled(sortList.Keys[i], e, now)
+				}
+			}
+		case <-s.changed:
+			timer.Stop()
+			now = s.now()
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// runTask runs t, registered under name and planned for the given time,
+// in its own goroutine tracked by s.wg, subject to the overlap policy of t.
+// dag is the DAG run that triggered t, nil for a scheduled run.
+func (s *Scheduler) runTask(ctx context.Context, name string, t Tasker, planned time.Time, dag *dagRun) {
+	s.runTasks(ctx, name, t, []time.Time{planned}, "", dag)
+}
+
+// runTasks is like runTask for runs planned at several times, such as
+// missed runs being made up for. They run one after another and count as a
+// single run for the overlap policy. reason says why they are late, if
+// they are.
+func (s *Scheduler) runTasks(ctx context.Context, name string, t Tasker, planned []time.Time, reason string, dag *dagRun) {
+	policy := OverlapAllow
+	if o, ok := t.(overlapper); ok {
+		policy = o.overlapPolicy()
+	}
+
+	s.mu.Lock()
+	if dag != nil && s.paused[name] {
+		s.mu.Unlock()
+		s.skipAll(ctx, name, t, planned, "paused", dag)
+		return
+	}
+	st := s.state(name)
+	if st.running > 0 && policy != OverlapAllow {
+		if policy == OverlapQueue && !st.queued {
+			st.queued = true
+			st.queuedAt = planned
+			st.queuedWhy = reason
+			st.queuedDAG = dag
+			s.mu.Unlock()
+			return
+		}
+		why := "previous run still in progress"
+		if st.queued {
+			why = "a run is already queued"
+		}
+		s.mu.Unlock()
+		s.skipAll(ctx, name, t, planned, joinReasons(reason, why), dag)
+		return
+	}
+	st.running++
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.execute(ctx, name, t, planned, reason, dag)
+	}()
+}
+
+// state returns the run state of the task registered under name; s.mu
+// must be held.
+func (s *Scheduler) state(name string) *taskState {
+	st := s.states[name]
+	if st == nil {
+		st = &taskState{}
+		s.states[name] = st
+	}
+	return st
+}
+
+// execute runs t at the planned times, then the run queued behind it, if
+// any. The caller must have counted the run in the state of name. Once a
+// run is over, the tasks depending on t are triggered, as part of dag if t
+// ran in one.
+func (s *Scheduler) execute(ctx context.Context, name string, t Tasker, planned []time.Time, reason string, dag *dagRun) {
+	for {
+		for i, p := range planned {
+			if i > 0 && ctx.Err() != nil {
+				s.skipAll(ctx, name, t, planned[i:], "scheduler stopped", dag)
+				break
+			}
+			s.executeOnce(ctx, name, t, p, reason, dag)
+		}
+
+		s.mu.Lock()
+		st := s.states[name]
+		if st.queued && ctx.Err() == nil {
+			st.queued = false
+			planned, reason, dag = st.queuedAt, joinReasons(st.queuedWhy, "queued: previous run still in progress"), st.queuedDAG
+			st.queuedAt, st.queuedDAG = nil, nil
+			s.mu.Unlock()
+			continue
+		}
+		queued, queuedAt, queuedDAG := st.queued, st.queuedAt, st.queuedDAG
+		st.queued, st.queuedAt, st.queuedDAG = false, nil, nil
+		if st.running--; st.running == 0 {
+			delete(s.states, name)
+		}
+		s.mu.Unlock()
+		if queued {
+			s.skipAll(ctx, name, t, queuedAt, "scheduler stopped", queuedDAG)
+		}
+		return
+	}
+}
+
+// executeOnce runs t once, planned for the given time, once it gets a
+// concurrency slot and the lease of the occurrence.
+func (s *Scheduler) executeOnce(ctx context.Context, name string, t Tasker, planned time.Time, reason string, dag *dagRun) {
+	ok, wait := s.acquire(ctx)
+	if !ok {
+		s.skip(ctx, name, t, planned, "scheduler stopped", dag)
+		return
+	}
+	defer s.release()
+	if wait != "" {
+		reason = joinReasons(reason, wait)
+	}
+	runCtx, lease, locked := s.lock(ctx, name, t, planned)
+	if locked != "" {
+		s.skip(ctx, name, t, planned, locked, dag)
+		return
+	}
+	start := s.now()
+	s.emit(Event{Kind: EventStart, Task: name, Planned: planned, Time: start})
+	var err error
+	if r, ok := t.(plannedRunner); ok {
+		err = r.runPlanned(runCtx, planned, reason)
+	} else {
+		err = t.Run()
+	}
+	end := s.now()
+	e := Event{Kind: EventSuccess, Task: name, Planned: planned, Time: end, Duration: end.Sub(start), Err: err}
+	if err != nil {
+		e.Kind = EventFailure
+	}
+	s.emit(e)
+	lease.end(err != nil)
+	s.saveLastRun(name, t, planned)
+	s.ran(ctx, name, planned, err, dag)
+}
+
+// skipAll skips the runs of t at the planned times.
+func (s *Scheduler) skipAll(ctx context.Context, name string, t Tasker, planned []time.Time, reason string, dag *dagRun) {
+	for _, p := range planned {
+		s.skip(ctx, name, t, p, reason, dag)
+	}
+}
+
+// acquire takes a concurrency slot, waiting for one if the scheduler is at
+// its limit. It returns false if ctx is done first; wait says why the run
+// was delayed, if it was.
+func (s *Scheduler) acquire(ctx context.Context) (ok bool, wait string) {
+	if s.slots == nil {
+		return true, ""
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return true, ""
+	default:
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return true, "queued: scheduler at max concurrency"
+	case <-ctx.Done():
+		return false, ""
+	}
+}
+
+func (s *Scheduler) release() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+// recordSkip notes a skipped run of t, if t keeps such records.
+func recordSkip(t Tasker, planned time.Time, reason string) {
+	if r, ok := t.(skipRecorder); ok {
+		r.recordSkip(planned, reason)
+	}
+}
+
+func joinReasons(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "; " + b
+}
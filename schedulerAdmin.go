@@ -0,0 +1,293 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrTaskNotFound is returned for operations on a task name that is not
+// registered.
+var ErrTaskNotFound = errors.New("utils: task not found")
+
+// ErrSpecUnsupported is returned by SetSpec for a task without a SetSpec
+// method.
+var ErrSpecUnsupported = errors.New("utils: task does not support changing its spec")
+
+// specSetter is implemented by tasks whose spec can be changed.
+type specSetter interface {
+	SetSpec(spec string) error
+}
+
+// historian is implemented by tasks that keep an execution history.
+type historian interface {
+	History() []Execution
+}
+
+// RunNow runs the named task once, now, outside its schedule. The run is
+// subject to the overlap policy of the task, also when it is paused.
+func (s *Scheduler) RunNow(name string) error {
+	s.mu.Lock()
+	t, ok := s.tasks[name]
+	ctx := s.ctx
+	if ctx == nil || !s.running {
+		ctx = context.Background()
+	}
+	s.mu.Unlock()
+	if !ok {
+		return ErrTaskNotFound
+	}
+	s.runTask(ctx, name, t, s.now(), nil)
+	return nil
+}
+
+// Pause stops the named task from running on its schedule until Resume is
+// called. Runs in progress are not interrupted.
+func (s *Scheduler) Pause(name string) error {
+	s.mu.Lock()
+	_, ok := s.tasks[name]
+	if ok {
+		s.paused[name] = true
+	}
+	s.mu.Unlock()
+	if !ok {
+		return ErrTaskNotFound
+	}
+	s.notify()
+	return nil
+}
+
+// Resume lets a paused task run on its schedule again, from now on.
+func (s *Scheduler) Resume(name string) error {
+	s.mu.Lock()
+	t, ok := s.tasks[name]
+	resumed := ok && s.paused[name] && s.running
+	delete(s.paused, name)
+	if resumed {
+		t.SetNext(s.now())
+	}
+	s.mu.Unlock()
+	if !ok {
+		return ErrTaskNotFound
+	}
+	if resumed {
+		s.scheduled(name, t, s.now())
+	}
+	s.notify()
+	return nil
+}
+
+// Paused reports whether the named task is paused.
+func (s *Scheduler) Paused(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused[name]
+}
+
+// SetSpec changes the spec of the named task, which must have a SetSpec
+// method like Task. The new schedule takes effect immediately.
+func (s *Scheduler) SetSpec(name, spec string) error {
+	s.mu.Lock()
+	t, ok := s.tasks[name]
+	s.mu.Unlock()
+	if !ok {
+		return ErrTaskNotFound
+	}
+	ss, ok := t.(specSetter)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrSpecUnsupported, name)
+	}
+	if err := ss.SetSpec(spec); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	running := s.running
+	if running {
+		t.SetNext(s.now())
+	}
+	s.mu.Unlock()
+	if running {
+		s.scheduled(name, t, s.now())
+	}
+	s.notify()
+	return nil
+}
+
+// active returns the tasks that are not paused; s.mu must be held.
+func (s *Scheduler) active() map[string]Tasker {
+	if len(s.paused) == 0 {
+		return s.tasks
+	}
+	m := make(map[string]Tasker, len(s.tasks))
+	for name, t := range s.tasks {
+		if !s.paused[name] {
+			m[name] = t
+		}
+	}
+	return m
+}
+
+// TaskInfo is the JSON view of a task served by the admin handler.
+type TaskInfo struct {
+	Name    string      `json:"name"`
+	Spec    string      `json:"spec"`
+	Prev    *time.Time  `json:"prev,omitempty"`
+	Next    *time.Time  `json:"next,omitempty"`
+	Paused  bool        `json:"paused"`
+	Errors  []Execution `json:"recentErrors,omitempty"`
+	History []Execution `json:"history,omitempty"`
+}
+
+// recentErrors is the number of failed runs listed by the admin handler.
+const recentErrors = 10
+
+func (s *Scheduler) taskInfo(name string, t Tasker, history bool) TaskInfo {
+	info := TaskInfo{Name: name, Spec: t.GetSpec(), Paused: s.Paused(name)}
+	if prev := t.GetPrev(); !prev.IsZero() {
+		info.Prev = &prev
+	}
+	if next := t.GetNext(); !next.IsZero() {
+		info.Next = &next
+	}
+	if h, ok := t.(historian); ok {
+		executions := h.History()
+		for i := len(executions) - 1; i >= 0 && len(info.Errors) < recentErrors; i-- {
+			if executions[i].Failed() {
+				info.Errors = append(info.Errors, executions[i])
+			}
+		}
+		if history {
+			info.History = executions
+		}
+	}
+	return info
+}
+
+// AdminHandler returns an http.Handler to inspect and control the tasks of
+// s. Mount it with http.StripPrefix; it serves
+//
+//	GET  /                 all tasks as a JSON list of TaskInfo
+//	GET  /{name}           one task, with its history
+//	POST /{name}/run       run the task now
+//	POST /{name}/pause     pause the task
+//	POST /{name}/resume    resume the task
+//	POST /{name}/spec      change the spec to the "spec" form value or the
+//	                       spec of a JSON body {"spec": "..."}
+//
+// Task names in paths are URL-escaped. Errors are JSON objects {"error":
+// "..."} with status 404 for an unknown task or action, 400 for a malformed
+// spec, 409 for a task whose spec cannot be changed and 500 otherwise.
+func (s *Scheduler) AdminHandler() http.Handler {
+	return http.HandlerFunc(s.serveAdmin)
+}
+
+func (s *Scheduler) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.EscapedPath(), "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		tasks := s.Tasks()
+		names := make([]string, 0, len(tasks))
+		for name := range tasks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		list := make([]TaskInfo, 0, len(names))
+		for _, name := range names {
+			list = append(list, s.taskInfo(name, tasks[name], false))
+		}
+		adminJSON(w, http.StatusOK, list)
+		return
+	}
+
+	escaped, action := path, ""
+	if i := strings.LastIndexByte(path, '/'); i >= 0 {
+		escaped, action = path[:i], path[i+1:]
+	}
+	name, err := url.PathUnescape(escaped)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "bad task name")
+		return
+	}
+	t, ok := s.Task(name)
+	if !ok {
+		adminError(w, http.StatusNotFound, ErrTaskNotFound.Error())
+		return
+	}
+
+	if action == "" {
+		if r.Method != http.MethodGet {
+			adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		adminJSON(w, http.StatusOK, s.taskInfo(name, t, true))
+		return
+	}
+	if r.Method != http.MethodPost {
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	switch action {
+	case "run":
+		err = s.RunNow(name)
+	case "pause":
+		err = s.Pause(name)
+	case "resume":
+		err = s.Resume(name)
+	case "spec":
+		spec := r.FormValue("spec")
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			var body struct {
+				Spec string `json:"spec"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				adminError(w, http.StatusBadRequest, "bad JSON body: "+err.Error())
+				return
+			}
+			spec = body.Spec
+		}
+		err = s.SetSpec(name, spec)
+	default:
+		adminError(w, http.StatusNotFound, "unknown action "+action)
+		return
+	}
+	if err != nil {
+		adminError(w, adminStatus(err), err.Error())
+		return
+	}
+	adminJSON(w, http.StatusOK, s.taskInfo(name, t, false))
+}
+
+// adminStatus returns the HTTP status code for an error of an admin action.
+func adminStatus(err error) int {
+	var specErr *SpecError
+	switch {
+	case errors.As(err, &specErr):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrTaskNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrSpecUnsupported):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func adminJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminError(w http.ResponseWriter, code int, msg string) {
+	adminJSON(w, code, map[string]string{"error": msg})
+}
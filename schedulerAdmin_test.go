@@ -0,0 +1,188 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSchedulerAdminHandler(t *testing.T) {
+	s := NewScheduler()
+	var runs int32
+	task := NewTask("nightly/report", "0 0 3 * * *", func() error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	})
+	s.AddTask("nightly/report", task)
+	s.AddTask("cleanup", NewScheduledTask("cleanup", Every(time.Hour), func() error { return nil }))
+	s.Start(context.Background())
+	defer s.Stop()
+
+	srv := httptest.NewServer(http.StripPrefix("/tasks", s.AdminHandler()))
+	defer srv.Close()
+	base := srv.URL + "/tasks/" + url.PathEscape("nightly/report")
+
+	resp, err := http.Get(srv.URL + "/tasks/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []TaskInfo
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 2 || list[0].Name != "cleanup" || list[1].Spec != "0 0 3 * * *" || list[1].Next == nil {
+		t.Fatalf("task list = %+v; want both tasks with spec and next time", list)
+	}
+
+	post := func(action string, form url.Values) int {
+		resp, err := http.PostForm(base+"/"+action, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	equal(t, http.StatusOK, post("run", nil))
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&runs) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("run now did not run the task")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	equal(t, http.StatusOK, post("pause", nil))
+	equal(t, true, s.Paused("nightly/report"))
+	equal(t, http.StatusOK, post("resume", nil))
+	equal(t, false, s.Paused("nightly/report"))
+
+	equal(t, http.StatusBadRequest, post("spec", url.Values{"spec": {"0 0 25 * * *"}}))
+	equal(t, http.StatusOK, post("spec", url.Values{"spec": {"0 30 4 * * *"}}))
+	equal(t, "0 30 4 * * *", task.GetSpec())
+	if next := task.GetNext(); next.Hour() != 4 || next.Minute() != 30 {
+		t.Errorf("next run after changing the spec = %v; want 04:30", next)
+	}
+
+	resp, err = http.Post(base+"/spec", "application/json", strings.NewReader(`{"spec": "@every 1m"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	equal(t, http.StatusOK, resp.StatusCode)
+	equal(t, "@every 1m", task.GetSpec())
+
+	resp, err = http.Get(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info TaskInfo
+	json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if len(info.History) != 1 {
+		t.Errorf("task history = %+v; want the manual run", info.History)
+	}
+
+	resp, err = http.PostForm(srv.URL+"/tasks/missing/run", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+// failingSpecTask is a task whose SetSpec fails for a reason other than a
+// malformed spec.
+type failingSpecTask struct{ Tasker }
+
+func (failingSpecTask) SetSpec(string) error { return errors.New("spec store unavailable") }
+
+func TestSchedulerAdminHandlerErrors(t *testing.T) {
+	s := NewScheduler()
+	noop := func() error { return nil }
+	s.AddTask("cron", NewTask("cron", "0 0 3 * * *", noop))
+	// Embedding only the Tasker interface hides the SetSpec method of Task.
+	s.AddTask("fixed", struct{ Tasker }{NewTask("fixed", "0 0 3 * * *", noop)})
+	s.AddTask("failing", failingSpecTask{NewTask("failing", "0 0 3 * * *", noop)})
+
+	srv := httptest.NewServer(s.AdminHandler())
+	defer srv.Close()
+	post := func(path string, form url.Values) (int, string) {
+		resp, err := http.PostForm(srv.URL+path, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body.Error
+	}
+
+	tests := []struct {
+		path, spec string
+		code       int
+	}{
+		{"/missing/run", "", http.StatusNotFound},
+		{"/missing/pause", "", http.StatusNotFound},
+		{"/missing/spec", "0 0 4 * * *", http.StatusNotFound},
+		{"/cron/stop", "", http.StatusNotFound},
+		{"/cron/spec", "0 0 25 * * *", http.StatusBadRequest},
+		{"/cron/spec", "@every never", http.StatusBadRequest},
+		{"/fixed/spec", "0 0 4 * * *", http.StatusConflict},
+		{"/failing/spec", "0 0 4 * * *", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		code, msg := post(tt.path, url.Values{"spec": {tt.spec}})
+		if code != tt.code || msg == "" {
+			t.Errorf("POST %s spec=%q = %d %q; want %d with an error message", tt.path, tt.spec, code, msg, tt.code)
+		}
+	}
+
+	for _, tt := range []struct {
+		err  error
+		code int
+	}{
+		{ErrTaskNotFound, http.StatusNotFound},
+		{fmt.Errorf("run: %w", ErrTaskNotFound), http.StatusNotFound},
+		{fmt.Errorf("%w: fixed", ErrSpecUnsupported), http.StatusConflict},
+		{&SpecError{Spec: "x", Msg: "bad"}, http.StatusBadRequest},
+		{errors.New("boom"), http.StatusInternalServerError},
+	} {
+		if code := adminStatus(tt.err); code != tt.code {
+			t.Errorf("adminStatus(%v) = %d; want %d", tt.err, code, tt.code)
+		}
+	}
+}
+
+func TestSchedulerPause(t *testing.T) {
+	s := NewScheduler()
+	var runs int32
+	s.AddTask("tick", NewScheduledTask("tick", Every(10*time.Millisecond), func() error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	}))
+	s.Pause("tick")
+	s.Start(context.Background())
+	defer s.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&runs); n != 0 {
+		t.Fatalf("paused task ran %d times", n)
+	}
+	s.Resume("tick")
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&runs) == 0 {
+		t.Error("resumed task did not run")
+	}
+	if err := s.Pause("missing"); err != ErrTaskNotFound {
+		t.Errorf("Pause of a missing task = %v; want ErrTaskNotFound", err)
+	}
+}
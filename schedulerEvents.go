@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"time"
+)
+
+// EventKind says what happened to a task.
+type EventKind int
+
+const (
+	// EventScheduled: the next run of the task was planned.
+	EventScheduled EventKind = iota
+	// EventStart: a run started.
+	EventStart
+	// EventSuccess: a run succeeded.
+	EventSuccess
+	// EventFailure: a run failed, or the scheduler could not load or save
+	// the last run time of the task.
+	EventFailure
+	// EventSkip: a run was skipped.
+	EventSkip
+	// EventRemoved: the task was deleted, or removed because its schedule
+	// ended.
+	EventRemoved
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventScheduled:
+		return "scheduled"
+	case EventStart:
+		return "start"
+	case EventSuccess:
+		return "success"
+	case EventFailure:
+		return "failure"
+	case EventSkip:
+		return "skip"
+	case EventRemoved:
+		return "removed"
+	}
+	return "unknown"
+}
+
+// Event is something that happened to a task of a scheduler.
+type Event struct {
+	Kind     EventKind
+	Task     string        // name the task is registered under
+	Planned  time.Time     // planned time of the run; the next run for EventScheduled
+	Time     time.Time     // when it happened, on the scheduler's clock
+	Duration time.Duration // of the run, for EventSuccess and EventFailure
+	Err      error         // for EventFailure
+	Reason   string        // why the run was skipped, for EventSkip
+}
+
+// EventHook is called with the events of a scheduler.
+type EventHook func(e Event)
+
+// Hooks are called by a scheduler as its tasks are scheduled, run, skipped
+// and removed. Nil hooks are not called. Hooks are called from the
+// goroutines of the scheduler and its runs, so they must be safe for
+// concurrent use and should return quickly.
+type Hooks struct {
+	OnScheduled EventHook
+	OnStart     EventHook
+	OnSuccess   EventHook
+	OnFailure   EventHook
+	OnSkip      EventHook
+	OnRemoved   EventHook
+}
+
+// EventBufferSize is the capacity of the channel returned by
+// Scheduler.Events.
+const EventBufferSize = 256
+
+// WithHooks makes the scheduler call h.
+func WithHooks(h Hooks) SchedulerOption {
+	return func(s *Scheduler) {
+		s.hooks = h
+	}
+}
+
+// Events returns a buffered channel receiving the events of the scheduler.
+// Events are dropped while the channel is full, so they must be received
+// promptly.
+func (s *Scheduler) Events() <-chan Event {
+	return s.events
+}
+
+// emit passes e to its hook and to the event channel; s.mu must not be
+// held.
+func (s *Scheduler) emit(e Event) {
+	var hook EventHook
+	switch e.Kind {
+	case EventScheduled:
+		hook = s.hooks.OnScheduled
+	case EventStart:
+		hook = s.hooks.OnStart
+	case EventSuccess:
+		hook = s.hooks.OnSuccess
+	case EventFailure:
+		hook = s.hooks.OnFailure
+	case EventSkip:
+		hook = s.hooks.OnSkip
+	case EventRemoved:
+		hook = s.hooks.OnRemoved
+	}
+	if hook != nil {
+		hook(e)
+	}
+	select {
+	case s.events <- e:
+	default:
+	}
+}
+
+// scheduled reports the next run of t, if it has one.
+func (s *Scheduler) scheduled(name string, t Tasker, now time.Time) {
+	if next := t.GetNext(); !next.IsZero() {
+		s.emit(Event{Kind: EventScheduled, Task: name, Planned: next, Time: now})
+	}
+}
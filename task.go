@@ -15,31 +15,45 @@
 package utils
 
 import (
-	"log"
+	"context"
+	"fmt"
 	"math"
+	"math/bits"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 // bounds provides a range of acceptable values (plus a map of name to value).
 type bounds struct {
+	field    string
 	min, max uint
 	names    map[string]uint
 }
 
+var (
+	// AdminTaskList is a snapshot of the tasks of DefaultScheduler, replaced
+	// by the package-level AddTask and DeleteTask. Changing it has no
+	// effect on the scheduler.
+	//
+	// Deprecated: use DefaultScheduler.Tasks, which also sees tasks added
+	// through DefaultScheduler directly.
+	AdminTaskList = make(map[string]Tasker)
+
+	// DefaultScheduler is the scheduler used by the package-level task
+	// functions.
+	DefaultScheduler = NewScheduler()
+)
+
 // The bounds for each field.
 var (
-	AdminTaskList map[string]Tasker
-	stop          chan bool
-	changed       chan bool
-	isStart       bool
-	seconds       = bounds{0, 59, nil}
-	minutes       = bounds{0, 59, nil}
-	hours         = bounds{0, 23, nil}
-	days          = bounds{1, 31, nil}
-	months        = bounds{1, 12, map[string]uint{
+	seconds = bounds{"second", 0, 59, nil}
+	minutes = bounds{"minute", 0, 59, nil}
+	hours   = bounds{"hour", 0, 23, nil}
+	days    = bounds{"day of month", 1, 31, nil}
+	months  = bounds{"month", 1, 12, map[string]uint{
 		"jan": 1,
 		"feb": 2,
 		"mar": 3,
@@ -53,7 +67,7 @@ var (
 		"nov": 11,
 		"dec": 12,
 	}}
-	weeks = bounds{0, 6, map[string]uint{
+	weeks = bounds{"day of week", 0, 6, map[string]uint{
 		"sun": 0,
 		"mon": 1,
 		"tue": 2,
@@ -77,6 +91,18 @@ type Schedule struct {
 	Day    uint64
 	Month  uint64
 	Week   uint64
+
+	// Location is the time zone the schedule is evaluated in, set by a
+	// CRON_TZ= or TZ= prefix. nil means the location of the time passed
+	// to Next.
+	Location *time.Location
+
+	// Day modifiers, matched in addition to the Day and Week bits.
+	lastDays    uint64 // bit n: n days before the last day of month (L, L-n)
+	lastWeekday bool   // last weekday (Monday to Friday) of month (LW)
+	nearWeekday uint64 // bit d: weekday nearest to day d of month (dW)
+	nthWeekday  uint64 // bit 8*w+n: n-th weekday w of month (w#n)
+	lastWeek    uint64 // bit w: last weekday w of month (wL)
 }
 
 // TaskFunc task func type
@@ -101,71 +127,215 @@ type taskErr struct {
 
 // Task task struct
 type Task struct {
+	mu       sync.Mutex // guards Prev, Next, ErrList and the history
 	TaskName string
-	Spec     *Schedule
+	Spec     TaskSchedule
 	SpecStr  string
+	Location *time.Location // time zone for specs without CRON_TZ=, nil means local time
 	DoFunc   TaskFunc
 	Prev     time.Time
 	Next     time.Time
 	ErrList  []*taskErr // like errTime:errInfo
-	ErrLimit int        // max length for the errList, 0 stand for no limit
+	ErrLimit int        // max length for the errList, the oldest errors are dropped first; 0 stand for no limit
+	Overlap  OverlapPolicy
+
+	// DoFuncCtx is run instead of DoFunc if it is set.
+	DoFuncCtx TaskFuncCtx
+
+	// DependsOn names the tasks this task runs after. Each time one of
+	// them runs on its schedule, the tasks depending on it, directly or
+	// through other tasks, run once all their dependencies ran; if a
+	// dependency fails, the tasks depending on it are skipped.
+	DependsOn []string
+
+	// HistoryLimit is the number of executions kept for History, 0 stand
+	// for DefaultHistoryLimit.
+	HistoryLimit int
+	history      executionRing
+
+	recover    bool
+	timeout    time.Duration
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	misfire    *MisfirePolicy // nil for none
+	misfireMax int
+	clock      Clock // nil means DefaultClock
+	aligned    bool  // whether an EverySchedule is aligned, see alignIntervals
 }
 
-// NewTask add new task with name, time and func
-func NewTask(tName string, spec string, f TaskFunc) *Task {
+// NewTask add new task with name, time, func and options. It panics if spec
+// is invalid; use NewTaskE for specs that come from users.
+func NewTask(tName string, spec string, f TaskFunc, opts ...TaskOption) *Task {
+	task, err := NewTaskE(tName, spec, f, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return task
+}
+
+// NewTaskE is like NewTask but returns an error instead of panicking when
+// spec is invalid.
+func NewTaskE(tName string, spec string, f TaskFunc, opts ...TaskOption) (*Task, error) {
+	task := &Task{
+		TaskName: tName,
+		DoFunc:   f,
+		ErrLimit: 100,
+	}
+	if err := task.SetSpec(spec); err != nil {
+		return nil, err
+	}
+	for _, opt := range opts {
+		opt(task)
+	}
+	return task, nil
+}
 
+// NewScheduledTask creates a task that runs f on schedule, e.g. Every(time.Minute)
+// or At(t). The spec string is taken from the schedule's String method if it
+// has one. schedule may be nil for a task that only runs after the tasks it
+// depends on.
+func NewScheduledTask(tName string, schedule TaskSchedule, f TaskFunc, opts ...TaskOption) *Task {
 	task := &Task{
 		TaskName: tName,
 		DoFunc:   f,
 		ErrLimit: 100,
-		SpecStr:  spec,
 	}
-	task.SetCron(spec)
+	task.SetSchedule(schedule)
+	for _, opt := range opts {
+		opt(task)
+	}
 	return task
 }
 
 // GetSpec get spec string
 func (t *Task) GetSpec() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	return t.SpecStr
 }
 
-// GetStatus get current task status
+// GetStatus get current task status: the failed and skipped runs in the
+// history, one per line, oldest first
 func (t *Task) GetStatus() string {
 	var str string
-	for _, v := range t.ErrList {
-		str += v.t.String() + ":" + v.errInfo + "<br>"
+	for _, e := range t.History() {
+		switch {
+		case e.Skipped:
+			str += e.Planned.String() + ":skipped: " + e.Reason + "<br>"
+		case e.Failed():
+			str += e.End.String() + ":" + e.Err.Error() + "<br>"
+		}
 	}
 	return str
 }
 
+// History returns the recent executions of the task, oldest first.
+func (t *Task) History() []Execution {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.history.list()
+}
+
+func (t *Task) overlapPolicy() OverlapPolicy {
+	return t.Overlap
+}
+
+func (t *Task) recordSkip(planned time.Time, reason string) {
+	t.mu.Lock()
+	t.history.add(Execution{Planned: planned, Skipped: true, Reason: reason}, t.HistoryLimit)
+	t.mu.Unlock()
+}
+
 // Run run all tasks
 func (t *Task) Run() error {
-	err := t.DoFunc()
+	return t.runPlanned(context.Background(), t.getClock().Now(), "")
+}
+
+func (t *Task) runPlanned(ctx context.Context, planned time.Time, reason string) error {
+	clock := t.getClock()
+	e := Execution{Planned: planned, Reason: reason, Start: clock.Now()}
+	t.runAttempts(ctx, clock, &e)
+	e.End = clock.Now()
+	e.Duration = e.End.Sub(e.Start)
+	err := e.Err
+
+	t.mu.Lock()
+	t.history.add(e, t.HistoryLimit)
 	if err != nil {
-		if t.ErrLimit > 0 && t.ErrLimit > len(t.ErrList) {
-			t.ErrList = append(t.ErrList, &taskErr{t: t.Next, errInfo: err.Error()})
+		if t.ErrLimit > 0 && len(t.ErrList) >= t.ErrLimit {
+			t.ErrList = append(t.ErrList[:0], t.ErrList[len(t.ErrList)-t.ErrLimit+1:]...)
 		}
+		t.ErrList = append(t.ErrList, &taskErr{t: e.End, errInfo: err.Error()})
 	}
+	t.mu.Unlock()
 	return err
 }
 
+func (t *Task) setClock(c Clock) {
+	t.mu.Lock()
+	t.clock = c
+	t.mu.Unlock()
+}
+
+// getClock returns the clock of the scheduler the task was added to.
+func (t *Task) getClock() Clock {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.clock == nil {
+		return DefaultClock()
+	}
+	return t.clock
+}
+
 // SetNext set next time for this task
 func (t *Task) SetNext(now time.Time) {
-	t.Next = t.Spec.Next(now)
+	t.mu.Lock()
+	if t.Location != nil {
+		now = now.In(t.Location)
+	}
+	t.Next = t.next(now)
+	t.mu.Unlock()
+}
+
+// next returns the run time of the task after now; t.mu must be held.
+func (t *Task) next(now time.Time) time.Time {
+	if t.Spec == nil {
+		return time.Time{}
+	}
+	if e, ok := t.Spec.(*EverySchedule); ok && t.aligned {
+		return e.alignedNext(now)
+	}
+	return t.Spec.Next(now)
+}
+
+func (t *Task) nextRun(after time.Time) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.Location != nil {
+		after = after.In(t.Location)
+	}
+	return t.next(after)
 }
 
 // GetNext get the next call time of this task
 func (t *Task) GetNext() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	return t.Next
 }
 
 // SetPrev set prev time of this task
 func (t *Task) SetPrev(now time.Time) {
+	t.mu.Lock()
 	t.Prev = now
+	t.mu.Unlock()
 }
 
 // GetPrev get prev time of this task
 func (t *Task) GetPrev() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	return t.Prev
 }
 
@@ -182,6 +352,10 @@ func (t *Task) GetPrev() time.Time {
 //       ,：　 separate signal
 //　　    －：duration
 //       /n : do as n times of time duration
+//       ?： any time, in the day and week fields only
+//       L： last day of month (L, L-n, LW), or last weekday of month (5L)
+//       W： weekday nearest to the day of month (15W), within the month
+//       #： n-th weekday of month (2#2 is the second Tuesday)
 /////////////////////////////////////////////////////////
 //	0/30 * * * * *                        every 30s
 //	0 43 21 * * *                         21:43
@@ -201,39 +375,164 @@ func (t *Task) GetPrev() time.Time {
 //	0 0 * * * *　　　　　　　　               0 min of hour in 1 hour duration
 //	0 2 8-20/3 * * *　　　　　　             8:02, 11:02, 14:02, 17:02, 20:02
 //	0 30 5 1,15 * *　　　　　　              5:30 on the 1st day and 15th day of month
+//	CRON_TZ=Asia/Shanghai 0 0 9 * * *      9:00 in Shanghai, whatever the local time zone
+//	0 0 0 L * ?                           0:00 on the last day of month
+//	0 0 0 15W * ?                         0:00 on the weekday nearest to the 15th
+//	0 0 0 ? * 2#2                         0:00 on the second Tuesday of month
+//	0 0 0 ? * 5L                          0:00 on the last Friday of month
+//	@every 1h30m                          every 90 minutes, counted from the previous run
 func (t *Task) SetCron(spec string) {
-	t.Spec = t.parse(spec)
+	if err := t.SetSpec(spec); err != nil {
+		panic(err)
+	}
+}
+
+// SetSpec parses spec like SetCron but returns an error instead of
+// panicking when it is invalid. Besides cron specs it accepts
+// "@every <duration>". The task is left unchanged on error.
+func (t *Task) SetSpec(spec string) error {
+	schedule, err := ParseTaskSchedule(spec)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.Spec = schedule
+	t.SpecStr = spec
+	t.mu.Unlock()
+	return nil
+}
+
+// SetSchedule sets the schedule of the task.
+func (t *Task) SetSchedule(schedule TaskSchedule) {
+	t.mu.Lock()
+	t.Spec = schedule
+	if s, ok := schedule.(fmt.Stringer); ok {
+		t.SpecStr = s.String()
+	} else {
+		t.SpecStr = ""
+	}
+	t.mu.Unlock()
+}
+
+// SpecError reports a malformed cron spec.
+type SpecError struct {
+	Spec  string // the spec being parsed
+	Field string // the field at fault, empty if the spec as a whole is wrong
+	Pos   int    // byte offset of the offending text in Spec
+	Msg   string
+}
+
+func (e *SpecError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("cron spec %q: %s", e.Spec, e.Msg)
+	}
+	return fmt.Sprintf("cron spec %q: %s field at position %d: %s", e.Spec, e.Field, e.Pos, e.Msg)
+}
+
+// MustParseSchedule is like ParseSchedule but panics if spec is invalid.
+func MustParseSchedule(spec string) *Schedule {
+	s, err := ParseSchedule(spec)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// ParseSchedule parses a cron spec as described by SetCron. Errors are of
+// type *SpecError and name the offending field, its position in spec and
+// the allowed range.
+func ParseSchedule(spec string) (*Schedule, error) {
+	p := specParser{spec: spec}
+	return p.parse()
+}
+
+// specParser parses one spec, remembering it for error messages.
+type specParser struct {
+	spec  string
+	sched *Schedule // receives the day modifiers
 }
 
-func (t *Task) parse(spec string) *Schedule {
-	if len(spec) > 0 && spec[0] == '@' {
-		return t.parseSpec(spec)
+func (p *specParser) errorf(field string, pos int, format string, args ...interface{}) *SpecError {
+	return &SpecError{Spec: p.spec, Field: field, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *specParser) parse() (*Schedule, error) {
+	// Split on whitespace, remembering where each field starts.
+	var fields []string
+	var pos []int
+	for i := 0; i < len(p.spec); {
+		if p.spec[i] == ' ' || p.spec[i] == '\t' {
+			i++
+			continue
+		}
+		j := i
+		for j < len(p.spec) && p.spec[j] != ' ' && p.spec[j] != '\t' {
+			j++
+		}
+		fields = append(fields, p.spec[i:j])
+		pos = append(pos, i)
+		i = j
+	}
+	if len(fields) == 0 {
+		return nil, p.errorf("", 0, "empty spec")
+	}
+
+	// An optional CRON_TZ=<zone> or TZ=<zone> prefix sets the time zone.
+	var loc *time.Location
+	if f := fields[0]; strings.HasPrefix(f, "CRON_TZ=") || strings.HasPrefix(f, "TZ=") {
+		eq := strings.IndexByte(f, '=')
+		var err error
+		if loc, err = time.LoadLocation(f[eq+1:]); err != nil || f[eq+1:] == "" {
+			return nil, p.errorf("time zone", pos[0]+eq+1, "unknown time zone %q", f[eq+1:])
+		}
+		fields, pos = fields[1:], pos[1:]
+		if len(fields) == 0 {
+			return nil, p.errorf("", len(p.spec), "missing schedule after time zone")
+		}
+	}
+
+	var schedule *Schedule
+	var err error
+	if fields[0][0] == '@' {
+		if len(fields) > 1 {
+			return nil, p.errorf("", pos[1], "unexpected text after descriptor %s", fields[0])
+		}
+		schedule, err = p.parseDescriptor(fields[0], pos[0])
+	} else {
+		schedule, err = p.parseFields(fields, pos)
+	}
+	if err != nil {
+		return nil, err
 	}
-	// Split on whitespace.  We require 5 or 6 fields.
-	// (second) (minute) (hour) (day of month) (month) (day of week, optional)
-	fields := strings.Fields(spec)
+	schedule.Location = loc
+	return schedule, nil
+}
+
+// parseFields parses the 5 or 6 fields:
+// (second) (minute) (hour) (day of month) (month) (day of week, optional)
+func (p *specParser) parseFields(fields []string, pos []int) (*Schedule, error) {
 	if len(fields) != 5 && len(fields) != 6 {
-		log.Panicf("Expected 5 or 6 fields, found %d: %s", len(fields), spec)
+		return nil, p.errorf("", 0, "expected 5 or 6 fields, found %d", len(fields))
 	}
 
 	// If a sixth field is not provided (DayOfWeek), then it is equivalent to star.
 	if len(fields) == 5 {
 		fields = append(fields, "*")
+		pos = append(pos, len(p.spec))
 	}
 
-	schedule := &Schedule{
-		Second: getField(fields[0], seconds),
-		Minute: getField(fields[1], minutes),
-		Hour:   getField(fields[2], hours),
-		Day:    getField(fields[3], days),
-		Month:  getField(fields[4], months),
-		Week:   getField(fields[5], weeks),
+	p.sched = &Schedule{}
+	bits := []*uint64{&p.sched.Second, &p.sched.Minute, &p.sched.Hour, &p.sched.Day, &p.sched.Month, &p.sched.Week}
+	for i, r := range []bounds{seconds, minutes, hours, days, months, weeks} {
+		var err error
+		if *bits[i], err = p.getField(fields[i], pos[i], r); err != nil {
+			return nil, err
+		}
 	}
-
-	return schedule
+	return p.sched, nil
 }
 
-func (t *Task) parseSpec(spec string) *Schedule {
+func (p *specParser) parseDescriptor(spec string, pos int) (*Schedule, error) {
 	switch spec {
 	case "@yearly", "@annually":
 		return &Schedule{
@@ -243,7 +542,7 @@ func (t *Task) parseSpec(spec string) *Schedule {
 			Day:    1 << days.min,
 			Month:  1 << months.min,
 			Week:   all(weeks),
-		}
+		}, nil
 
 	case "@monthly":
 		return &Schedule{
@@ -253,7 +552,7 @@ func (t *Task) parseSpec(spec string) *Schedule {
 			Day:    1 << days.min,
 			Month:  all(months),
 			Week:   all(weeks),
-		}
+		}, nil
 
 	case "@weekly":
 		return &Schedule{
@@ -263,7 +562,7 @@ func (t *Task) parseSpec(spec string) *Schedule {
 			Day:    all(days),
 			Month:  all(months),
 			Week:   1 << weeks.min,
-		}
+		}, nil
 
 	case "@daily", "@midnight":
 		return &Schedule{
@@ -273,7 +572,7 @@ func (t *Task) parseSpec(spec string) *Schedule {
 			Day:    all(days),
 			Month:  all(months),
 			Week:   all(weeks),
-		}
+		}, nil
 
 	case "@hourly":
 		return &Schedule{
@@ -283,180 +582,435 @@ func (t *Task) parseSpec(spec string) *Schedule {
 			Day:    all(days),
 			Month:  all(months),
 			Week:   all(weeks),
-		}
+		}, nil
 	}
-	log.Panicf("Unrecognized descriptor: %s", spec)
-	return nil
+	return nil, p.errorf("", pos, "unrecognized descriptor %s", spec)
 }
 
-// Next set schedule to next time
+// Next returns the first time after t that matches the schedule, in the
+// location of t. The schedule is evaluated in s.Location, or in the location
+// of t if s.Location is nil.
+//
+// Across daylight saving time transitions Next behaves like Vixie cron.
+// A wall-clock time skipped by a spring-forward gap fires at the first
+// instant after the gap. A wall-clock time repeated by a fall-back overlap
+// fires once, at its first occurrence, unless the hour field is a wildcard:
+// such schedules keep firing at their usual pace through the repeated hour.
 func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	if s.Location != nil {
+		loc = s.Location
+	}
 
-	// Start at the earliest possible time (the upcoming second).
-	t = t.Add(1*time.Second - time.Duration(t.Nanosecond())*time.Nanosecond)
+	var next time.Time
+	if s.Hour&starBit > 0 {
+		next = s.nextByZone(t.In(loc))
+	} else {
+		next = s.nextByWall(t.In(loc))
+	}
+	if next.IsZero() {
+		return next
+	}
+	return next.In(t.Location())
+}
+
+// nextByWall advances the wall clock, so a time skipped by a gap is still
+// seen, and maps each match to its first occurrence.
+func (s *Schedule) nextByWall(from time.Time) time.Time {
+	w := wallClock(from).Add(time.Second)
+	for {
+		if w = s.nextWall(w); w.IsZero() {
+			return w
+		}
+		if next := inLocation(w, from.Location()); next.After(from) {
+			return next
+		}
+		w = w.Add(time.Second)
+	}
+}
 
-	// This flag indicates whether a field has been incremented.
-	added := false
+// nextByZone walks through the periods of constant UTC offset, so a wall
+// clock repeated by an overlap is seen in both periods.
+func (s *Schedule) nextByZone(from time.Time) time.Time {
+	// Start at the earliest possible time (the upcoming second).
+	t := from.Add(1*time.Second - time.Duration(from.Nanosecond())*time.Nanosecond)
+	for {
+		w := s.nextWall(wallClock(t))
+		if w.IsZero() {
+			return w
+		}
+		_, offset := t.Zone()
+		end := zoneEnd(t)
+		next := time.Unix(w.Unix()-int64(offset), 0).In(t.Location())
+		if end.IsZero() || next.Before(end) {
+			return next
+		}
+		t = end
+	}
+}
 
-	// If no time is found within five years, return zero.
-	yearLimit := t.Year() + 5
+// Prev returns the last time before t that matches the schedule, in the
+// location of t, or the zero time if there is none. It is the reverse of
+// Next, so Prev(Next(t)) is the last run at or before t, with the same
+// handling of daylight saving time transitions.
+func (s *Schedule) Prev(t time.Time) time.Time {
+	loc := t.Location()
+	if s.Location != nil {
+		loc = s.Location
+	}
 
-WRAP:
-	if t.Year() > yearLimit {
-		return time.Time{}
+	var prev time.Time
+	if s.Hour&starBit > 0 {
+		prev = s.prevByZone(t.In(loc))
+	} else {
+		prev = s.prevByWall(t.In(loc))
 	}
+	if prev.IsZero() {
+		return prev
+	}
+	return prev.In(t.Location())
+}
 
-	// Find the first applicable month.
-	// If it's this month, then do nothing.
-	for 1<<uint(t.Month())&s.Month == 0 {
-		// If we have to add a month, reset the other parts to 0.
-		if !added {
-			added = true
-			// Otherwise, set the date at the beginning (since the current time is irrelevant).
-			t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+// prevByWall is nextByWall run backwards.
+func (s *Schedule) prevByWall(from time.Time) time.Time {
+	// A time in the second pass of a fall-back overlap comes after the
+	// first pass through the same wall clock, so start from the end of
+	// the first pass.
+	w := wallClock(from.Add(-time.Nanosecond))
+	if start, _ := from.ZoneBounds(); !start.IsZero() {
+		_, offset := from.Zone()
+		_, before := start.Add(-time.Second).Zone()
+		if overlap := time.Duration(before-offset) * time.Second; from.Sub(start) < overlap {
+			w = wallClock(start.Add(-time.Second))
+		}
+	}
+	for {
+		if w = s.prevWall(w); w.IsZero() {
+			return w
 		}
-		t = t.AddDate(0, 1, 0)
+		if prev := inLocation(w, from.Location()); prev.Before(from) {
+			return prev
+		}
+		w = w.Add(-time.Second)
+	}
+}
 
-		// Wrapped around.
-		if t.Month() == time.January {
-			goto WRAP
+// prevByZone is nextByZone run backwards.
+func (s *Schedule) prevByZone(from time.Time) time.Time {
+	// Start at the latest possible time (the second before from).
+	t := time.Unix(from.Add(-time.Nanosecond).Unix(), 0).In(from.Location())
+	for {
+		w := s.prevWall(wallClock(t))
+		if w.IsZero() {
+			return w
 		}
+		_, offset := t.Zone()
+		start, _ := t.ZoneBounds()
+		prev := time.Unix(w.Unix()-int64(offset), 0).In(t.Location())
+		if start.IsZero() || !prev.Before(start) {
+			return prev
+		}
+		t = start.Add(-time.Second)
 	}
+}
 
-	// Now get a day in that month.
-	for !dayMatches(s, t) {
-		if !added {
-			added = true
-			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+// nextWall returns the first wall-clock time at or after t that matches the
+// schedule, or the zero time if there is none. Wall-clock times are
+// represented in UTC, which has no daylight saving time, so plain calendar
+// arithmetic applies.
+//
+// Each field jumps straight to its next matching value; when a field runs
+// out of values, the field above it moves on by one and the fields below
+// start over from their first value.
+func (s *Schedule) nextWall(t time.Time) time.Time {
+	y, mo, d := t.Date()
+	h, mi, sec := t.Clock()
+	month := int(mo)
+
+	// The calendar repeats every 400 years: a schedule that does not
+	// match within 400 years never matches.
+	for limit := y + 400; y <= limit; {
+		m, ok := nextBit(s.Month, month, 12)
+		if !ok {
+			y, month, d, h, mi, sec = y+1, 1, 1, 0, 0, 0
+			continue
+		}
+		if m != month {
+			month, d, h, mi, sec = m, 1, 0, 0, 0
 		}
-		t = t.AddDate(0, 0, 1)
 
-		if t.Day() == 1 {
-			goto WRAP
+		mask, last := s.dayMask(y, time.Month(month))
+		day, ok := nextBit(mask, d, last)
+		if !ok {
+			month, d, h, mi, sec = month+1, 1, 0, 0, 0
+			continue
+		}
+		if day != d {
+			d, h, mi, sec = day, 0, 0, 0
+		}
+
+		hour, ok := nextBit(s.Hour, h, 23)
+		if !ok {
+			d, h, mi, sec = d+1, 0, 0, 0
+			continue
+		}
+		if hour != h {
+			h, mi, sec = hour, 0, 0
 		}
-	}
 
-	for 1<<uint(t.Hour())&s.Hour == 0 {
-		if !added {
-			added = true
-			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+		minute, ok := nextBit(s.Minute, mi, 59)
+		if !ok {
+			h, mi, sec = h+1, 0, 0
+			continue
+		}
+		if minute != mi {
+			mi, sec = minute, 0
 		}
-		t = t.Add(1 * time.Hour)
 
-		if t.Hour() == 0 {
-			goto WRAP
+		second, ok := nextBit(s.Second, sec, 59)
+		if !ok {
+			mi, sec = mi+1, 0
+			continue
 		}
+		return time.Date(y, time.Month(month), d, h, mi, second, 0, time.UTC)
 	}
+	return time.Time{}
+}
 
-	for 1<<uint(t.Minute())&s.Minute == 0 {
-		if !added {
-			added = true
-			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, t.Location())
+// prevWall returns the last wall-clock time at or before t that matches the
+// schedule, or the zero time if there is none. It is nextWall run
+// backwards.
+func (s *Schedule) prevWall(t time.Time) time.Time {
+	y, mo, d := t.Date()
+	h, mi, sec := t.Clock()
+	month := int(mo)
+
+	for limit := y - 400; y >= limit; {
+		m, ok := prevBit(s.Month, month, 1)
+		if !ok {
+			y, month, d, h, mi, sec = y-1, 12, 31, 23, 59, 59
+			continue
+		}
+		if m != month {
+			month, d, h, mi, sec = m, 31, 23, 59, 59
 		}
-		t = t.Add(1 * time.Minute)
 
-		if t.Minute() == 0 {
-			goto WRAP
+		mask, last := s.dayMask(y, time.Month(month))
+		if d > last {
+			d, h, mi, sec = last, 23, 59, 59
+		}
+		day, ok := prevBit(mask, d, 1)
+		if !ok {
+			month, d, h, mi, sec = month-1, 31, 23, 59, 59
+			continue
+		}
+		if day != d {
+			d, h, mi, sec = day, 23, 59, 59
+		}
+
+		hour, ok := prevBit(s.Hour, h, 0)
+		if !ok {
+			d, h, mi, sec = d-1, 23, 59, 59
+			continue
+		}
+		if hour != h {
+			h, mi, sec = hour, 59, 59
 		}
-	}
 
-	for 1<<uint(t.Second())&s.Second == 0 {
-		if !added {
-			added = true
-			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, t.Location())
+		minute, ok := prevBit(s.Minute, mi, 0)
+		if !ok {
+			h, mi, sec = h-1, 59, 59
+			continue
+		}
+		if minute != mi {
+			mi, sec = minute, 59
 		}
-		t = t.Add(1 * time.Second)
 
-		if t.Second() == 0 {
-			goto WRAP
+		second, ok := prevBit(s.Second, sec, 0)
+		if !ok {
+			mi, sec = mi-1, 59
+			continue
 		}
+		return time.Date(y, time.Month(month), d, h, mi, second, 0, time.UTC)
 	}
+	return time.Time{}
+}
 
-	return t
+// nextBit returns the lowest bit of b that is set, at least v and at most
+// max.
+func nextBit(b uint64, v, max int) (int, bool) {
+	if v > max {
+		return 0, false
+	}
+	b &= (1<<uint(max+1) - 1) &^ (1<<uint(v) - 1)
+	if b == 0 {
+		return 0, false
+	}
+	return bits.TrailingZeros64(b), true
 }
 
-func dayMatches(s *Schedule, t time.Time) bool {
-	var (
-		domMatch = 1<<uint(t.Day())&s.Day > 0
-		dowMatch = 1<<uint(t.Weekday())&s.Week > 0
-	)
+// prevBit returns the highest bit of b that is set, at most v and at least
+// min.
+func prevBit(b uint64, v, min int) (int, bool) {
+	if v < min {
+		return 0, false
+	}
+	b &= (1<<uint(v+1) - 1) &^ (1<<uint(min) - 1)
+	if b == 0 {
+		return 0, false
+	}
+	return 63 - bits.LeadingZeros64(b), true
+}
 
-	if s.Day&starBit > 0 || s.Week&starBit > 0 {
-		return domMatch && dowMatch
+// wallClock returns the wall clock of t, truncated to the second, as a UTC
+// time.
+func wallClock(t time.Time) time.Time {
+	y, mo, d := t.Date()
+	h, mi, sec := t.Clock()
+	return time.Date(y, mo, d, h, mi, sec, 0, time.UTC)
+}
+
+// zoneEnd returns the end of the period of constant UTC offset that t is
+// in, or the zero time if the offset never changes. Past the end of the
+// transition table of a zone, ZoneBounds can return an end that is not
+// after t on the last day of a leap year; the offset does not change there,
+// so zoneEnd looks again an hour later.
+func zoneEnd(t time.Time) time.Time {
+	for u := t; ; u = u.Add(time.Hour) {
+		if _, end := u.ZoneBounds(); end.IsZero() || end.After(u) {
+			return end
+		}
 	}
-	return domMatch || dowMatch
 }
 
-// StartTask start all tasks
-func StartTask() {
-	if isStart {
-		//If already started， no need to start another goroutine.
-		return
+// inLocation returns the first instant at which the wall clock w occurs in
+// loc. If w is skipped by a daylight saving gap, it returns the first
+// instant after the gap.
+func inLocation(w time.Time, loc *time.Location) time.Time {
+	y, mo, d := w.Date()
+	h, mi, sec := w.Clock()
+	t := time.Date(y, mo, d, h, mi, sec, 0, loc)
+
+	if got := wallClock(t); !got.Equal(w) {
+		// time.Date normalized w to one side of the gap.
+		start, end := t.ZoneBounds()
+		if got.Before(w) {
+			return end
+		}
+		return start
 	}
-	isStart = true
-	go run()
+	return t
 }
 
-func run() {
-	now := time.Now().Local()
-	for _, t := range AdminTaskList {
-		t.SetNext(now)
+// dayMask returns the days of the given month that match the schedule, as
+// bits 1 to 31, and the number of days in the month.
+func (s *Schedule) dayMask(y int, m time.Month) (mask uint64, last int) {
+	last = 31
+	switch m {
+	case time.February:
+		last = 28
+		if y%4 == 0 && (y%100 != 0 || y%400 == 0) {
+			last = 29
+		}
+	case time.April, time.June, time.September, time.November:
+		last = 30
+	}
+	month := getBits(1, uint(last), 1)
+	first := time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+
+	dom := s.Day & month
+	if s.lastDays != 0 {
+		for n := 0; n < last; n++ {
+			if s.lastDays&(1<<uint(n)) > 0 {
+				dom |= 1 << uint(last-n)
+			}
+		}
+	}
+	if s.lastWeekday {
+		dom |= 1 << uint(nearestWeekday(first, last))
+	}
+	for d := 1; s.nearWeekday != 0 && d <= last; d++ {
+		if s.nearWeekday&(1<<uint(d)) > 0 {
+			dom |= 1 << uint(nearestWeekday(first, d))
+		}
 	}
 
-	for {
-		sortList := NewMapSorter(AdminTaskList)
-		sortList.Sort()
-		var effective time.Time
-		if len(AdminTaskList) == 0 || sortList.Vals[0].GetNext().IsZero() {
-			// If there are no entries yet, just sleep - it still handles new entries
-			// and stop requests.
-			effective = now.AddDate(10, 0, 0)
-		} else {
-			effective = sortList.Vals[0].GetNext()
-		}
-		select {
-		case now = <-time.After(effective.Sub(now)):
-			// Run every entry whose next time was this effective time.
-			for _, e := range sortList.Vals {
-				if e.GetNext() != effective {
-					break
+	dow := month
+	if s.Week&^starBit != getBits(weeks.min, weeks.max, 1) || s.nthWeekday != 0 || s.lastWeek != 0 {
+		dow = 0
+		wd1 := int(first.Weekday())
+		for w := 0; w <= 6; w++ {
+			// The first day of the month that falls on weekday w.
+			d1 := 1 + (w-wd1+7)%7
+			if s.Week&(1<<uint(w)) > 0 {
+				for d := d1; d <= last; d += 7 {
+					dow |= 1 << uint(d)
 				}
-				go e.Run()
-				e.SetPrev(e.GetNext())
-				e.SetNext(effective)
 			}
-			continue
-		case <-changed:
-			continue
-		case <-stop:
-			return
+			for n := 1; n <= 5; n++ {
+				if d := d1 + 7*(n-1); d <= last && s.nthWeekday&(1<<uint(8*w+n)) > 0 {
+					dow |= 1 << uint(d)
+				}
+			}
+			if s.lastWeek&(1<<uint(w)) > 0 {
+				dow |= 1 << uint(d1+(last-d1)/7*7)
+			}
 		}
 	}
+
+	if s.Day&starBit > 0 || s.Week&starBit > 0 {
+		return dom & dow, last
+	}
+	return dom | dow, last
 }
 
-// StopTask stop all tasks
-func StopTask() {
-	if isStart {
-		isStart = false
-		stop <- true
+// daysIn returns the number of days in the month of t.
+func daysIn(t time.Time) int {
+	return time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// nearestWeekday returns the weekday (Monday to Friday) nearest to day d of
+// the month of t, without leaving the month.
+func nearestWeekday(t time.Time, d int) int {
+	last := daysIn(t)
+	switch time.Date(t.Year(), t.Month(), d, 0, 0, 0, 0, time.UTC).Weekday() {
+	case time.Saturday:
+		if d == 1 {
+			return 3
+		}
+		return d - 1
+	case time.Sunday:
+		if d == last {
+			return d - 2
+		}
+		return d + 1
 	}
+	return d
+}
+
+// StartTask start all tasks
+func StartTask() {
+	DefaultScheduler.Start(context.Background())
+}
 
+// StopTask stop all tasks
+func StopTask() {
+	DefaultScheduler.Stop()
 }
 
-// AddTask add task with name
-func AddTask(taskName string, t Tasker) {
-	AdminTaskList[taskName] = t
-	if isStart {
-		changed <- true
+// AddTask add task with name, see Scheduler.AddTask
+func AddTask(taskName string, t Tasker) error {
+	if err := DefaultScheduler.AddTask(taskName, t); err != nil {
+		return err
 	}
+	AdminTaskList = DefaultScheduler.Tasks()
+	return nil
 }
 
 // DeleteTask delete task with name
 func DeleteTask(taskName string) {
-	delete(AdminTaskList, taskName)
-	if isStart {
-		changed <- true
-	}
+	DefaultScheduler.DeleteTask(taskName)
+	AdminTaskList = DefaultScheduler.Tasks()
 }
 
 // MapSorter sort map for tasker
@@ -498,41 +1052,75 @@ func (ms *MapSorter) Swap(i, j int) {
 	ms.Keys[i], ms.Keys[j] = ms.Keys[j], ms.Keys[i]
 }
 
-func getField(field string, r bounds) uint64 {
+// getField returns the bits of a comma-separated list of ranges; pos is
+// the offset of field in the spec.
+func (p *specParser) getField(field string, pos int, r bounds) (uint64, error) {
 	// list = range {"," range}
 	var bits uint64
-	ranges := strings.FieldsFunc(field, func(r rune) bool { return r == ',' })
-	for _, expr := range ranges {
-		bits |= getRange(expr, r)
+	for start := 0; start <= len(field); {
+		end := strings.IndexByte(field[start:], ',')
+		if end < 0 {
+			end = len(field)
+		} else {
+			end += start
+		}
+		if end == start {
+			return 0, p.errorf(r.field, pos+start, "empty list element")
+		}
+		b, err := p.getRange(field[start:end], pos+start, r)
+		if err != nil {
+			return 0, err
+		}
+		bits |= b
+		start = end + 1
 	}
-	return bits
+	return bits, nil
 }
 
 // getRange returns the bits indicated by the given expression:
 //   number | number "-" number [ "/" number ]
-func getRange(expr string, r bounds) uint64 {
+// pos is the offset of expr in the spec. Day modifiers are recorded in
+// p.sched and contribute no bits.
+func (p *specParser) getRange(expr string, pos int, r bounds) (uint64, error) {
+	if expr == "?" {
+		if r.field != days.field && r.field != weeks.field {
+			return 0, p.errorf(r.field, pos, "? is only allowed in the day of month and day of week fields")
+		}
+		return all(r), nil
+	}
+	if ok, err := p.getModifier(expr, pos, r); ok || err != nil {
+		return 0, err
+	}
 
 	var (
 		start, end, step uint
+		err              error
 		rangeAndStep     = strings.Split(expr, "/")
 		lowAndHigh       = strings.Split(rangeAndStep[0], "-")
 		singleDigit      = len(lowAndHigh) == 1
 	)
 
 	var extraStar uint64
-	if lowAndHigh[0] == "*" || lowAndHigh[0] == "?" {
+	if lowAndHigh[0] == "*" {
+		if len(lowAndHigh) > 1 {
+			return 0, p.errorf(r.field, pos+1, "unexpected range after %s", lowAndHigh[0])
+		}
 		start = r.min
 		end = r.max
 		extraStar = starBit
 	} else {
-		start = parseIntOrName(lowAndHigh[0], r.names)
+		if start, err = p.parseIntOrName(lowAndHigh[0], pos, r); err != nil {
+			return 0, err
+		}
 		switch len(lowAndHigh) {
 		case 1:
 			end = start
 		case 2:
-			end = parseIntOrName(lowAndHigh[1], r.names)
+			if end, err = p.parseIntOrName(lowAndHigh[1], pos+len(lowAndHigh[0])+1, r); err != nil {
+				return 0, err
+			}
 		default:
-			log.Panicf("Too many hyphens: %s", expr)
+			return 0, p.errorf(r.field, pos+len(lowAndHigh[0])+len(lowAndHigh[1])+1, "too many hyphens in %q", expr)
 		}
 	}
 
@@ -540,50 +1128,119 @@ func getRange(expr string, r bounds) uint64 {
 	case 1:
 		step = 1
 	case 2:
-		step = mustParseInt(rangeAndStep[1])
+		stepPos := pos + len(rangeAndStep[0]) + 1
+		if step, err = p.parseUint(rangeAndStep[1], stepPos, r); err != nil {
+			return 0, err
+		}
+		if step == 0 {
+			return 0, p.errorf(r.field, stepPos, "step must be at least 1")
+		}
 
 		// Special handling: "N/step" means "N-max/step".
 		if singleDigit {
 			end = r.max
 		}
 	default:
-		log.Panicf("Too many slashes: %s", expr)
+		return 0, p.errorf(r.field, pos+len(rangeAndStep[0])+len(rangeAndStep[1])+1, "too many slashes in %q", expr)
 	}
 
-	if start < r.min {
-		log.Panicf("Beginning of range (%d) below minimum (%d): %s", start, r.min, expr)
-	}
-	if end > r.max {
-		log.Panicf("End of range (%d) above maximum (%d): %s", end, r.max, expr)
-	}
 	if start > end {
-		log.Panicf("Beginning of range (%d) beyond end of range (%d): %s", start, end, expr)
+		return 0, p.errorf(r.field, pos, "range start %d is beyond range end %d", start, end)
 	}
 
-	return getBits(start, end, step) | extraStar
+	return getBits(start, end, step) | extraStar, nil
 }
 
-// parseIntOrName returns the (possibly-named) integer contained in expr.
-func parseIntOrName(expr string, names map[string]uint) uint {
-	if names != nil {
-		if namedInt, ok := names[strings.ToLower(expr)]; ok {
-			return namedInt
+// getModifier parses the L, W and # day modifiers into p.sched. It reports
+// whether expr was a modifier.
+func (p *specParser) getModifier(expr string, pos int, r bounds) (bool, error) {
+	upper := strings.ToUpper(expr)
+	switch r.field {
+	case days.field:
+		switch {
+		case upper == "LW":
+			p.sched.lastWeekday = true
+		case upper == "L":
+			p.sched.lastDays |= 1
+		case strings.HasPrefix(upper, "L-"):
+			n, err := p.parseUint(expr[2:], pos+2, bounds{field: r.field, min: 0, max: 30})
+			if err != nil {
+				return true, err
+			}
+			if n > 30 {
+				return true, p.errorf(r.field, pos+2, "offset %d out of range 0-30", n)
+			}
+			p.sched.lastDays |= 1 << n
+		case strings.HasSuffix(upper, "W"):
+			d, err := p.parseIntOrName(expr[:len(expr)-1], pos, r)
+			if err != nil {
+				return true, err
+			}
+			p.sched.nearWeekday |= 1 << d
+		default:
+			return false, nil
 		}
+		return true, nil
+
+	case weeks.field:
+		if i := strings.IndexByte(expr, '#'); i >= 0 {
+			w, err := p.parseIntOrName(expr[:i], pos, r)
+			if err != nil {
+				return true, err
+			}
+			n, err := p.parseUint(expr[i+1:], pos+i+1, bounds{field: r.field, min: 1, max: 5})
+			if err != nil {
+				return true, err
+			}
+			if n < 1 || n > 5 {
+				return true, p.errorf(r.field, pos+i+1, "occurrence %d out of range 1-5", n)
+			}
+			p.sched.nthWeekday |= 1 << (8*w + n)
+			return true, nil
+		}
+		if len(upper) > 1 && strings.HasSuffix(upper, "L") {
+			w, err := p.parseIntOrName(expr[:len(expr)-1], pos, r)
+			if err != nil {
+				return true, err
+			}
+			p.sched.lastWeek |= 1 << w
+			return true, nil
+		}
+	}
+	if strings.ContainsAny(upper, "LW#") && r.names == nil {
+		return true, p.errorf(r.field, pos, "modifier in %q is not allowed in the %s field", expr, r.field)
 	}
-	return mustParseInt(expr)
+	return false, nil
 }
 
-// mustParseInt parses the given expression as an int or panics.
-func mustParseInt(expr string) uint {
-	num, err := strconv.Atoi(expr)
+// parseIntOrName returns the (possibly-named) integer contained in expr,
+// checked against the bounds of the field.
+func (p *specParser) parseIntOrName(expr string, pos int, r bounds) (uint, error) {
+	if r.names != nil {
+		if namedInt, ok := r.names[strings.ToLower(expr)]; ok {
+			return namedInt, nil
+		}
+	}
+	num, err := p.parseUint(expr, pos, r)
 	if err != nil {
-		log.Panicf("Failed to parse int from %s: %s", expr, err)
+		return 0, err
 	}
-	if num < 0 {
-		log.Panicf("Negative number (%d) not allowed: %s", num, expr)
+	if num < r.min || num > r.max {
+		return 0, p.errorf(r.field, pos, "value %d out of range %d-%d", num, r.min, r.max)
 	}
+	return num, nil
+}
 
-	return uint(num)
+// parseUint parses expr as a non-negative integer.
+func (p *specParser) parseUint(expr string, pos int, r bounds) (uint, error) {
+	num, err := strconv.Atoi(expr)
+	if err != nil || num < 0 {
+		if r.names != nil {
+			return 0, p.errorf(r.field, pos, "invalid value %q, want %d-%d or a name", expr, r.min, r.max)
+		}
+		return 0, p.errorf(r.field, pos, "invalid value %q, want %d-%d", expr, r.min, r.max)
+	}
+	return uint(num), nil
 }
 
 // getBits sets all bits in the range [min, max], modulo the given step size.
@@ -606,9 +1263,3 @@ func getBits(min, max, step uint) uint64 {
 func all(r bounds) uint64 {
 	return getBits(r.min, r.max, 1) | starBit
 }
-
-func init() {
-	AdminTaskList = make(map[string]Tasker)
-	stop = make(chan bool)
-	changed = make(chan bool)
-}
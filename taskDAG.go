@@ -0,0 +1,184 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrDependencyCycle is returned by AddTask when the dependencies of the
+// task would form a cycle.
+var ErrDependencyCycle = errors.New("utils: dependency cycle")
+
+// WithDependsOn makes the task run after each run of the named tasks in the
+// same scheduler. See Task.DependsOn.
+func WithDependsOn(names ...string) TaskOption {
+	return func(t *Task) {
+		t.DependsOn = append(t.DependsOn, names...)
+	}
+}
+
+// dependent is implemented by tasks that depend on other tasks.
+type dependent interface {
+	dependsOn() []string
+}
+
+func (t *Task) dependsOn() []string {
+	return t.DependsOn
+}
+
+func dependencies(t Tasker) []string {
+	if d, ok := t.(dependent); ok {
+		return d.dependsOn()
+	}
+	return nil
+}
+
+// checkCycle returns an error if registering t under name would make the
+// dependencies of the tasks cyclic; s.mu must be held.
+func (s *Scheduler) checkCycle(name string, t Tasker) error {
+	deps := func(n string) []string {
+		if n == name {
+			return dependencies(t)
+		}
+		return dependencies(s.tasks[n])
+	}
+
+	// Depth-first search from name, looking for a way back to it.
+	var path []string
+	visited := make(map[string]bool)
+	var visit func(n string) bool
+	visit = func(n string) bool {
+		path = append(path, n)
+		for _, up := range deps(n) {
+			if up == name {
+				path = append(path, up)
+				return true
+			}
+			if !visited[up] {
+				visited[up] = true
+				if visit(up) {
+					return true
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	if visit(name) {
+		return fmt.Errorf("%w: %s", ErrDependencyCycle, strings.Join(path, " -> "))
+	}
+	return nil
+}
+
+// dagRun is one run of the tasks downstream of a task that ran on its
+// schedule, the root. A downstream task runs once all its upstream tasks
+// within the run finished; tasks that do not depend on each other run in
+// parallel. If an upstream task fails or is skipped, its downstream tasks
+// are skipped.
+type dagRun struct {
+	s       *Scheduler
+	planned time.Time // planned time of the root run
+
+	tasks    map[string]Tasker   // downstream tasks, by name
+	children map[string][]string // downstream tasks, by upstream task
+
+	mu      sync.Mutex
+	pending map[string]int    // upstream tasks not finished yet
+	failed  map[string]string // why a downstream task is skipped
+}
+
+// ran reports the end of a run of the named task, in dag or on its
+// schedule if dag is nil.
+func (s *Scheduler) ran(ctx context.Context, name string, planned time.Time, err error, dag *dagRun) {
+	var outcome string
+	if err != nil {
+		outcome = "failed: " + err.Error()
+	}
+	if dag != nil {
+		dag.finish(ctx, name, outcome)
+	} else {
+		s.startDAG(ctx, name, planned, outcome)
+	}
+}
+
+// skip records a skipped run of t, and skips its downstream tasks if it was
+// to run in dag.
+func (s *Scheduler) skip(ctx context.Context, name string, t Tasker, planned time.Time, reason string, dag *dagRun) {
+	recordSkip(t, planned, reason)
+	s.emit(Event{Kind: EventSkip, Task: name, Planned: planned, Time: s.now(), Reason: reason})
+	if dag != nil {
+		dag.finish(ctx, name, "skipped: "+reason)
+	}
+}
+
+// startDAG triggers the tasks downstream of root after it ran on its
+// schedule. outcome is empty if the root run succeeded.
+func (s *Scheduler) startDAG(ctx context.Context, root string, planned time.Time, outcome string) {
+	d := &dagRun{
+		s:        s,
+		planned:  planned,
+		tasks:    make(map[string]Tasker),
+		children: make(map[string][]string),
+		pending:  make(map[string]int),
+		failed:   make(map[string]string),
+	}
+
+	s.mu.Lock()
+	children := make(map[string][]string)
+	for name, t := range s.tasks {
+		for _, up := range dependencies(t) {
+			children[up] = append(children[up], name)
+		}
+	}
+	seen := map[string]bool{root: true}
+	for queue := []string{root}; len(queue) > 0; queue = queue[1:] {
+		for _, c := range children[queue[0]] {
+			d.children[queue[0]] = append(d.children[queue[0]], c)
+			if !seen[c] {
+				seen[c] = true
+				d.tasks[c] = s.tasks[c]
+				queue = append(queue, c)
+			}
+		}
+	}
+	// Dependencies outside the run do not hold it up.
+	for name, t := range d.tasks {
+		for _, up := range dependencies(t) {
+			if seen[up] {
+				d.pending[name]++
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if len(d.tasks) > 0 {
+		d.finish(ctx, root, outcome)
+	}
+}
+
+// finish notes the end of the named task in the run and starts the
+// downstream tasks that are ready. outcome is empty if the task succeeded.
+func (d *dagRun) finish(ctx context.Context, name, outcome string) {
+	for _, c := range d.children[name] {
+		d.mu.Lock()
+		if outcome != "" && d.failed[c] == "" {
+			d.failed[c] = "upstream " + name + " " + outcome
+		}
+		d.pending[c]--
+		ready, reason := d.pending[c] == 0, d.failed[c]
+		d.mu.Unlock()
+		if !ready {
+			continue
+		}
+
+		if reason != "" {
+			d.s.skip(ctx, c, d.tasks[c], d.planned, reason, d)
+			continue
+		}
+		d.s.runTask(ctx, c, d.tasks[c], d.planned, d)
+	}
+}
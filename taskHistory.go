@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// DefaultHistoryLimit is the number of executions a task keeps when its
+// HistoryLimit is not set.
+const DefaultHistoryLimit = 100
+
+// Execution is the record of one planned run of a task.
+type Execution struct {
+	Planned  time.Time     // the time the run was scheduled for
+	Start    time.Time     // zero if the run was skipped
+	End      time.Time     // zero if the run was skipped
+	Duration time.Duration // End - Start
+	Err      error         // the error returned by the task, if any
+	Panic    bool          // whether the task panicked; Err holds the panic value
+	Skipped  bool          // whether the run was skipped, see Reason
+	Reason   string        // why the run was skipped or delayed, if it was
+	Attempts int           // number of times the task func was called
+}
+
+// Failed reports whether the run returned an error or panicked.
+func (e Execution) Failed() bool {
+	return e.Err != nil
+}
+
+// MarshalJSON encodes the execution with Err as a string.
+func (e Execution) MarshalJSON() ([]byte, error) {
+	v := struct {
+		Planned  time.Time  `json:"planned"`
+		Start    *time.Time `json:"start,omitempty"`
+		End      *time.Time `json:"end,omitempty"`
+		Duration int64      `json:"durationNs"`
+		Err      string     `json:"error,omitempty"`
+		Panic    bool       `json:"panic,omitempty"`
+		Skipped  bool       `json:"skipped,omitempty"`
+		Reason   string     `json:"reason,omitempty"`
+		Attempts int        `json:"attempts,omitempty"`
+	}{
+		Planned:  e.Planned,
+		Duration: int64(e.Duration),
+		Panic:    e.Panic,
+		Skipped:  e.Skipped,
+		Reason:   e.Reason,
+		Attempts: e.Attempts,
+	}
+	if !e.Start.IsZero() {
+		v.Start = &e.Start
+	}
+	if !e.End.IsZero() {
+		v.End = &e.End
+	}
+	if e.Err != nil {
+		v.Err = e.Err.Error()
+	}
+	return json.Marshal(v)
+}
+
+// executionRing keeps the most recent executions, dropping the oldest once
+// it is full.
+type executionRing struct {
+	buf  []Execution
+	next int // index of the oldest entry once buf is full
+}
+
+func (r *executionRing) add(e Execution, limit int) {
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+	if len(r.buf) > limit {
+		// The limit was lowered; keep the newest entries.
+		r.buf = append(r.buf[:0:0], r.list()[len(r.buf)-limit:]...)
+		r.next = 0
+	}
+	if len(r.buf) < limit {
+		if r.next != 0 {
+			// The limit was raised after the ring wrapped; unwrap it so
+			// the new entries go after the newest one.
+			r.buf = r.list()
+			r.next = 0
+		}
+		r.buf = append(r.buf, e)
+		return
+	}
+	r.buf[r.next] = e
+	r.next = (r.next + 1) % limit
+}
+
+// list returns the executions from oldest to newest.
+func (r *executionRing) list() []Execution {
+	out := make([]Execution, 0, len(r.buf))
+	out = append(out, r.buf[r.next:]...)
+	return append(out, r.buf[:r.next]...)
+}
@@ -0,0 +1,234 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrLeaseLost is returned by Locker.Renew and Locker.Release when the
+// lease is no longer held by the given token, e.g. because it expired and
+// was taken by another holder.
+var ErrLeaseLost = errors.New("utils: lease lost")
+
+// Locker hands out named leases with a TTL. Schedulers of several replicas
+// share a Locker so that each occurrence of a task runs on only one of
+// them.
+type Locker interface {
+	// Acquire takes the lease name for ttl. ok is false if the lease is
+	// held by someone else. The returned token identifies the holder in
+	// Renew and Release.
+	Acquire(name string, ttl time.Duration) (token string, ok bool, err error)
+	// Renew extends the lease to ttl from now.
+	Renew(name, token string, ttl time.Duration) error
+	// Release gives up the lease before it expires.
+	Release(name, token string) error
+}
+
+// DefaultLockTTL is the lease TTL used by WithLocker when it is given none.
+const DefaultLockTTL = time.Minute
+
+// WithLocker makes the scheduler take a lease from l for each occurrence of
+// a task before running it, and skip the occurrence if another replica
+// holds the lease. The lease is taken for ttl and renewed while the run is
+// in progress. After a successful run it is kept until it expires, so a
+// replica whose clock lags does not run the occurrence again; after a
+// failed run it is released. ttl <= 0 means DefaultLockTTL.
+//
+// Replicas agree on an occurrence by its planned time. The Every schedules
+// of Tasks added to the scheduler are therefore aligned to multiples of
+// their interval rather than counted from the start of the scheduler;
+// other Taskers on interval schedules must align their run times
+// themselves.
+func WithLocker(l Locker, ttl time.Duration) SchedulerOption {
+	return func(s *Scheduler) {
+		if ttl <= 0 {
+			ttl = DefaultLockTTL
+		}
+		s.locker = l
+		s.lockTTL = ttl
+	}
+}
+
+// intervalAligner is implemented by tasks that can align their interval
+// schedules, for schedulers with a Locker.
+type intervalAligner interface {
+	alignIntervals()
+	// lockTime returns the time identifying the occurrence planned at the
+	// given time, without its jitter.
+	lockTime(planned time.Time) time.Time
+}
+
+func (t *Task) alignIntervals() {
+	t.mu.Lock()
+	t.aligned = true
+	t.mu.Unlock()
+}
+
+func (t *Task) lockTime(planned time.Time) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.Spec.(*EverySchedule); ok && t.aligned {
+		return planned.Truncate(e.Interval)
+	}
+	return planned
+}
+
+// lockName returns the lease name for the occurrence of the named task
+// planned at the given time.
+func lockName(name string, planned time.Time) string {
+	return name + "@" + strconv.FormatInt(planned.Unix(), 10)
+}
+
+// taskLease is a lease held for one run.
+type taskLease struct {
+	s      *Scheduler
+	name   string
+	token  string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// lock takes the lease for the occurrence of the named task planned at the
+// given time. It returns the context for the run, which is canceled if the
+// lease is lost, and the lease to end once the run is over. If the lease
+// could not be taken, reason says why.
+func (s *Scheduler) lock(ctx context.Context, name string, t Tasker, planned time.Time) (context.Context, *taskLease, string) {
+	if s.locker == nil {
+		return ctx, nil, ""
+	}
+	if a, ok := t.(intervalAligner); ok {
+		planned = a.lockTime(planned)
+	}
+	ln := lockName(name, planned)
+	token, ok, err := s.locker.Acquire(ln, s.lockTTL)
+	if err != nil {
+		return ctx, nil, "lock: " + err.Error()
+	}
+	if !ok {
+		return ctx, nil, "lock held by another scheduler"
+	}
+
+	l := &taskLease{s: s, name: ln, token: token, done: make(chan struct{})}
+	ctx, l.cancel = context.WithCancel(ctx)
+	go l.renew(ctx)
+	return ctx, l, ""
+}
+
+// renew renews the lease until the run is over, and cancels the run if the
+// lease is lost.
+func (l *taskLease) renew(ctx context.Context) {
+	defer close(l.done)
+	interval := l.s.lockTTL / 3
+	if interval <= 0 {
+		interval = time.Second
+	}
+	clock := l.s.getClock()
+	for {
+		timer := clock.NewTimer(interval)
+		select {
+		case <-timer.C():
+			if err := l.s.locker.Renew(l.name, l.token, l.s.lockTTL); err != nil {
+				l.cancel()
+				return
+			}
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// end stops renewing the lease, and releases it if the run failed.
+func (l *taskLease) end(failed bool) {
+	if l == nil {
+		return
+	}
+	l.cancel()
+	<-l.done
+	if failed {
+		l.s.locker.Release(l.name, l.token)
+	}
+}
+
+// MemoryLocker is a Locker for schedulers in a single process.
+type MemoryLocker struct {
+	mu     sync.Mutex
+	leases map[string]memoryLease
+	clock  Clock // nil means DefaultClock
+}
+
+type memoryLease struct {
+	token   string
+	expires time.Time
+}
+
+// NewMemoryLocker creates an empty MemoryLocker.
+func NewMemoryLocker() *MemoryLocker {
+	return NewMemoryLockerWithClock(nil)
+}
+
+// NewMemoryLockerWithClock creates an empty MemoryLocker that expires
+// leases on c, e.g. the FakeClock of the schedulers sharing it. A nil c
+// means DefaultClock.
+func NewMemoryLockerWithClock(c Clock) *MemoryLocker {
+	return &MemoryLocker{leases: make(map[string]memoryLease), clock: c}
+}
+
+func (m *MemoryLocker) now() time.Time {
+	if m.clock == nil {
+		return DefaultClock().Now()
+	}
+	return m.clock.Now()
+}
+
+// Acquire takes the lease name for ttl unless it is held and not expired.
+func (m *MemoryLocker) Acquire(name string, ttl time.Duration) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	if l, ok := m.leases[name]; ok && now.Before(l.expires) {
+		return "", false, nil
+	}
+	m.purge(now)
+	token := MustNewUUID().String()
+	m.leases[name] = memoryLease{token: token, expires: now.Add(ttl)}
+	return token, true, nil
+}
+
+// Renew extends the lease name held by token to ttl from now.
+func (m *MemoryLocker) Renew(name, token string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	l, ok := m.leases[name]
+	if !ok || l.token != token || !now.Before(l.expires) {
+		return ErrLeaseLost
+	}
+	l.expires = now.Add(ttl)
+	m.leases[name] = l
+	return nil
+}
+
+// Release gives up the lease name held by token.
+func (m *MemoryLocker) Release(name, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.leases[name]
+	if !ok || l.token != token || !m.now().Before(l.expires) {
+		return ErrLeaseLost
+	}
+	delete(m.leases, name)
+	return nil
+}
+
+// purge drops expired leases; m.mu must be held.
+func (m *MemoryLocker) purge(now time.Time) {
+	for name, l := range m.leases {
+		if !now.Before(l.expires) {
+			delete(m.leases, name)
+		}
+	}
+}
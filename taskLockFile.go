@@ -0,0 +1,187 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package utils
+
+import (
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FileLocker is a Locker for schedulers on one machine. Each lease is a
+// file in a directory, holding the token and expiry of its holder; flock
+// serializes the processes reading and writing it.
+type FileLocker struct {
+	dir string
+
+	mu        sync.Mutex
+	lastPurge time.Time
+}
+
+// NewFileLocker returns a FileLocker keeping its lease files in dir, which
+// is created if needed.
+func NewFileLocker(dir string) (*FileLocker, error) {
+	if err := EnsureDir(dir); err != nil {
+		return nil, err
+	}
+	return &FileLocker{dir: dir}, nil
+}
+
+// Acquire takes the lease name for ttl unless it is held and not expired.
+func (fl *FileLocker) Acquire(name string, ttl time.Duration) (string, bool, error) {
+	fl.purge(ttl)
+	token := MustNewUUID().String()
+	ok := false
+	err := fl.update(fl.path(name), true, func(holder string, expires time.Time, now time.Time) (string, time.Time, error) {
+		if holder != "" && now.Before(expires) {
+			return holder, expires, nil
+		}
+		ok = true
+		return token, now.Add(ttl), nil
+	})
+	if err != nil || !ok {
+		return "", false, err
+	}
+	return token, true, nil
+}
+
+// Renew extends the lease name held by token to ttl from now.
+func (fl *FileLocker) Renew(name, token string, ttl time.Duration) error {
+	return fl.update(fl.path(name), false, func(holder string, expires time.Time, now time.Time) (string, time.Time, error) {
+		if holder != token || !now.Before(expires) {
+			return holder, expires, ErrLeaseLost
+		}
+		return token, now.Add(ttl), nil
+	})
+}
+
+// Release gives up the lease name held by token.
+func (fl *FileLocker) Release(name, token string) error {
+	return fl.update(fl.path(name), false, func(holder string, expires time.Time, now time.Time) (string, time.Time, error) {
+		if holder != token || !now.Before(expires) {
+			return holder, expires, ErrLeaseLost
+		}
+		return "", time.Time{}, nil
+	})
+}
+
+func (fl *FileLocker) path(name string) string {
+	return filepath.Join(fl.dir, url.PathEscape(name)+".lock")
+}
+
+// update reads the lease in the file at fp under an exclusive flock and
+// writes back what f returns. An empty holder removes the file. Unless
+// create is set, a missing file is passed to f as no lease and is not
+// created.
+func (fl *FileLocker) update(fp string, create bool, f func(holder string, expires, now time.Time) (string, time.Time, error)) error {
+	file, err := fl.openLocked(fp, create)
+	if !create && os.IsNotExist(err) {
+		_, _, err = f("", time.Time{}, time.Now())
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	b, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	holder, expires := parseLease(string(b))
+	newHolder, newExpires, err := f(holder, expires, time.Now())
+	if err != nil {
+		return err
+	}
+	if newHolder == "" {
+		// Remove while still holding the flock; processes waiting for it
+		// notice the file is gone and open a new one.
+		return os.Remove(fp)
+	}
+	if newHolder == holder && newExpires.Equal(expires) {
+		return nil
+	}
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = file.WriteAt([]byte(newHolder+" "+strconv.FormatInt(newExpires.UnixNano(), 10)), 0)
+	return err
+}
+
+// openLocked opens the file at fp, creating it if needed and create is
+// set, and takes an exclusive flock on it. It retries if the file was
+// removed or replaced while waiting for the flock.
+func (fl *FileLocker) openLocked(fp string, create bool) (*os.File, error) {
+	flag := os.O_RDWR
+	if create {
+		flag |= os.O_CREATE
+	}
+	for {
+		file, err := os.OpenFile(fp, flag, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+			file.Close()
+			return nil, err
+		}
+		fi, err := file.Stat()
+		if err == nil {
+			var cur os.FileInfo
+			if cur, err = os.Stat(fp); err == nil && os.SameFile(fi, cur) {
+				return file, nil
+			}
+		}
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// parseLease parses the "token expiry" contents of a lease file.
+func parseLease(s string) (holder string, expires time.Time) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return "", time.Time{}
+	}
+	ns, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}
+	}
+	return fields[0], time.Unix(0, ns)
+}
+
+// purge removes expired lease files, at most once per ttl, so the files of
+// past occurrences do not pile up.
+func (fl *FileLocker) purge(ttl time.Duration) {
+	fl.mu.Lock()
+	now := time.Now()
+	if now.Sub(fl.lastPurge) < ttl {
+		fl.mu.Unlock()
+		return
+	}
+	fl.lastPurge = now
+	fl.mu.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(fl.dir, "*.lock"))
+	if err != nil {
+		return
+	}
+	for _, fp := range files {
+		fl.update(fp, false, func(holder string, expires, now time.Time) (string, time.Time, error) {
+			if holder != "" && now.Before(expires) {
+				return holder, expires, nil
+			}
+			return "", time.Time{}, nil
+		})
+	}
+}
@@ -0,0 +1,52 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package utils
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLocker(t *testing.T) {
+	dir := t.TempDir()
+	l, err := NewFileLocker(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testLocker(t, l)
+
+	// A second locker on the same directory, as in another process, sees
+	// the leases of the first.
+	other, err := NewFileLocker(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := l.Acquire("shared@1", time.Second); !ok {
+		t.Fatal("Acquire() of a free lease failed")
+	}
+	if _, ok, _ := other.Acquire("shared@1", time.Second); ok {
+		t.Error("a lease held through one locker should be held for the other")
+	}
+
+	// Expired lease files are purged.
+	if _, ok, _ := l.Acquire("old@1", time.Millisecond); !ok {
+		t.Fatal("Acquire() of a free lease failed")
+	}
+	time.Sleep(5 * time.Millisecond)
+	other.Acquire("new@1", time.Millisecond)
+	if files, _ := filepath.Glob(filepath.Join(dir, "old*")); len(files) != 0 {
+		t.Errorf("expired lease files %v were not purged", files)
+	}
+
+	// Renewing or releasing a missing lease leaves no file behind.
+	if err := l.Renew("gone@1", "token", time.Second); err != ErrLeaseLost {
+		t.Errorf("Renew() of a missing lease = %v; want ErrLeaseLost", err)
+	}
+	if err := l.Release("gone@1", "token"); err != ErrLeaseLost {
+		t.Errorf("Release() of a missing lease = %v; want ErrLeaseLost", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "gone*")); len(files) != 0 {
+		t.Errorf("lease files %v were created for a missing lease", files)
+	}
+}
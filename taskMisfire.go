@@ -0,0 +1,265 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// MisfirePolicy decides what happens to runs that were missed because the
+// scheduler was not running, or because the clock jumped or the process
+// was suspended. Tasks without a policy, including every Tasker other than
+// Task, simply run late and do not make up for runs missed while the
+// scheduler was not running.
+type MisfirePolicy int
+
+const (
+	// MisfireSkip drops missed runs, including runs that are due but more
+	// than a second late; the task next runs on schedule.
+	MisfireSkip MisfirePolicy = iota
+	// MisfireRunOnce runs the task once for all missed runs.
+	MisfireRunOnce
+	// MisfireRunAll runs the task for every missed run, oldest first, up
+	// to the limit given to WithMisfire.
+	MisfireRunAll
+)
+
+func (p MisfirePolicy) String() string {
+	switch p {
+	case MisfireSkip:
+		return "skip"
+	case MisfireRunOnce:
+		return "run once"
+	case MisfireRunAll:
+		return "run all"
+	}
+	return "unknown"
+}
+
+// misfireThreshold is how late a run may start before it counts as missed.
+const misfireThreshold = time.Second
+
+// WithMisfire sets the misfire policy of the task. max limits the number of
+// missed runs made up for by MisfireRunAll; max <= 0 means 1. Missed runs
+// are detected across restarts only if the scheduler has a StateStore.
+// Runs made up for count as a single run for the overlap policy of the
+// task and run one after another.
+func WithMisfire(p MisfirePolicy, max int) TaskOption {
+	return func(t *Task) {
+		t.misfire = &p
+		t.misfireMax = max
+	}
+}
+
+// misfirer is implemented by tasks that may have a misfire policy.
+type misfirer interface {
+	// misfirePolicy returns the policy and its limit; ok is false if the
+	// task has none.
+	misfirePolicy() (p MisfirePolicy, max int, ok bool)
+}
+
+func (t *Task) misfirePolicy() (MisfirePolicy, int, bool) {
+	if t.misfire == nil {
+		return MisfireSkip, 0, false
+	}
+	return *t.misfire, t.misfireMax, true
+}
+
+// StateStore persists the last run time of each task, so runs missed while
+// the scheduler was not running can be made up for.
+type StateStore interface {
+	// Load returns the last run time saved for the named task, or the
+	// zero time if there is none.
+	Load(name string) (time.Time, error)
+	// Save records the last run time of the named task.
+	Save(name string, last time.Time) error
+}
+
+// WithStateStore makes the scheduler save the last run time of tasks with a
+// misfire policy to store, and check it for missed runs when it starts.
+func WithStateStore(store StateStore) SchedulerOption {
+	return func(s *Scheduler) {
+		s.store = store
+	}
+}
+
+// FileStateStore is a StateStore that keeps the last run times in a JSON
+// file, rewritten atomically on every save.
+type FileStateStore struct {
+	mu    sync.Mutex
+	path  string
+	state map[string]time.Time // nil until loaded
+}
+
+// NewFileStateStore returns a store backed by the JSON file at path. The
+// file is created on the first save.
+func NewFileStateStore(path string) *FileStateStore {
+	return &FileStateStore{path: path}
+}
+
+// Load returns the last run time of the named task.
+func (fs *FileStateStore) Load(name string) (time.Time, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.load(); err != nil {
+		return time.Time{}, err
+	}
+	return fs.state[name], nil
+}
+
+// Save records the last run time of the named task.
+func (fs *FileStateStore) Save(name string, last time.Time) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.load(); err != nil {
+		return err
+	}
+	fs.state[name] = last
+	return fs.write()
+}
+
+func (fs *FileStateStore) load() error {
+	if fs.state != nil {
+		return nil
+	}
+	state := make(map[string]time.Time)
+	b, err := os.ReadFile(fs.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &state); err != nil {
+			return err
+		}
+	}
+	fs.state = state
+	return nil
+}
+
+func (fs *FileStateStore) write() error {
+	b, err := json.MarshalIndent(fs.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := EnsureDir(Dir(fs.path)); err != nil {
+		return err
+	}
+	// A temp file of its own, so stores saving to the same path at once
+	// do not write into each other's file.
+	f, err := os.CreateTemp(Dir(fs.path), Basename(fs.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if err = f.Chmod(0644); err == nil {
+		_, err = f.Write(b)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := Close(f); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		Remove(tmp)
+		return err
+	}
+	return Rename(tmp, fs.path)
+}
+
+// nextRunner is implemented by tasks that can tell their run times
+// without changing their state.
+type nextRunner interface {
+	nextRun(after time.Time) time.Time
+}
+
+// missedRuns returns up to max+1 run times of t from first and not after
+// now, oldest first.
+func missedRuns(t nextRunner, first, now time.Time, max int) []time.Time {
+	var missed []time.Time
+	for next := first; !next.IsZero() && !next.After(now) && len(missed) <= max; next = t.nextRun(next) {
+		missed = append(missed, next)
+	}
+	return missed
+}
+
+// catchUp checks the state store for runs of t missed while the scheduler
+// was not running.
+func (s *Scheduler) catchUp(ctx context.Context, name string, t Tasker, now time.Time) {
+	n, ok := t.(nextRunner)
+	if s.store == nil || !ok || !hasMisfirePolicy(t) {
+		return
+	}
+	last, err := s.store.Load(name)
+	if err != nil {
+		s.emit(Event{Kind: EventFailure, Task: name, Time: now, Err: fmt.Errorf("loading last run time: %w", err)})
+		return
+	}
+	if last.IsZero() {
+		// Nothing to catch up on; remember when we started.
+		s.saveLastRun(name, t, now)
+		return
+	}
+	if first := n.nextRun(last); !first.IsZero() && !first.After(now) {
+		s.misfired(ctx, name, t, first, now, "scheduler was not running")
+	}
+}
+
+// saveLastRun records planned as the last run time of t in the state store.
+func (s *Scheduler) saveLastRun(name string, t Tasker, planned time.Time) {
+	if s.store == nil || !hasMisfirePolicy(t) {
+		return
+	}
+	if err := s.store.Save(name, planned); err != nil {
+		s.emit(Event{Kind: EventFailure, Task: name, Planned: planned, Time: s.now(), Err: fmt.Errorf("saving last run time: %w", err)})
+	}
+}
+
+// hasMisfirePolicy reports whether t has a misfire policy.
+func hasMisfirePolicy(t Tasker) bool {
+	m, ok := t.(misfirer)
+	if !ok {
+		return false
+	}
+	_, _, ok = m.misfirePolicy()
+	return ok
+}
+
+// misfired makes up for the runs of t from first up to now according to
+// its misfire policy. why says how the runs were missed.
+func (s *Scheduler) misfired(ctx context.Context, name string, t Tasker, first, now time.Time, why string) {
+	policy, max := MisfireSkip, 1
+	if m, ok := t.(misfirer); ok {
+		policy, max, _ = m.misfirePolicy()
+	}
+	if max <= 0 || policy != MisfireRunAll {
+		max = 1
+	}
+
+	missed := []time.Time{first}
+	if n, ok := t.(nextRunner); ok {
+		missed = missedRuns(n, first, now, max)
+	}
+	if len(missed) == 0 {
+		return
+	}
+
+	reason := "misfire: " + why
+	switch policy {
+	case MisfireSkip:
+		s.skip(ctx, name, t, missed[0], reason, nil)
+		return
+	case MisfireRunOnce:
+		missed = missed[:1]
+	case MisfireRunAll:
+		if len(missed) > max {
+			s.skip(ctx, name, t, missed[max], reason+", more runs missed than the misfire limit", nil)
+			missed = missed[:max]
+		}
+	}
+
+	s.runTasks(ctx, name, t, missed, reason, nil)
+}
@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// TaskFuncCtx is a task func that receives a context, which is done when
+// the run times out or the scheduler stops.
+type TaskFuncCtx func(ctx context.Context) error
+
+// TaskOption configures a Task.
+type TaskOption func(*Task)
+
+// WithRecover makes a panic in the task func fail the run instead of
+// crashing the process. The run is recorded with Execution.Panic set.
+func WithRecover() TaskOption {
+	return func(t *Task) {
+		t.recover = true
+	}
+}
+
+// WithTimeout sets a deadline for each attempt of a run. The context passed
+// to a TaskFuncCtx is done once the deadline passes; a TaskFunc has no
+// context and is not interrupted.
+func WithTimeout(d time.Duration) TaskOption {
+	return func(t *Task) {
+		t.timeout = d
+	}
+}
+
+// WithRetry retries a failed run up to max times. The n-th retry waits
+// base*2^(n-1), at most maxBackoff if it is positive, with a random jitter
+// of up to half the delay taken off. A retry that would start at or after
+// the next scheduled run is not attempted.
+func WithRetry(max int, base, maxBackoff time.Duration) TaskOption {
+	return func(t *Task) {
+		t.retries = max
+		t.backoff = base
+		t.maxBackoff = maxBackoff
+	}
+}
+
+// WithOverlap sets the overlap policy of the task.
+func WithOverlap(p OverlapPolicy) TaskOption {
+	return func(t *Task) {
+		t.Overlap = p
+	}
+}
+
+// NewTaskCtx creates a task that runs the context-aware f on spec.
+func NewTaskCtx(tName string, spec string, f TaskFuncCtx, opts ...TaskOption) (*Task, error) {
+	task, err := NewTaskE(tName, spec, nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	task.DoFuncCtx = f
+	return task, nil
+}
+
+// backoffDelay returns the delay before retry n, counting from 1. Without
+// maxBackoff, the delay stops doubling before it would overflow.
+func (t *Task) backoffDelay(n int) time.Duration {
+	d := t.backoff
+	for i := 1; i < n && (t.maxBackoff <= 0 || d < t.maxBackoff) && d <= math.MaxInt64/2; i++ {
+		d *= 2
+	}
+	if t.maxBackoff > 0 && d > t.maxBackoff {
+		d = t.maxBackoff
+	}
+	if d > 1 {
+		d -= time.Duration(rand.Int63n(int64(d / 2)))
+	}
+	return d
+}
+
+// attempt runs the task func once, applying the timeout and recovering
+// from a panic if the task is configured to.
+func (t *Task) attempt(ctx context.Context) (panicked bool, err error) {
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+	if t.recover {
+		defer func() {
+			if r := recover(); r != nil {
+				panicked, err = true, fmt.Errorf("panic: %v", r)
+			}
+		}()
+	}
+	if t.DoFuncCtx != nil {
+		return false, t.DoFuncCtx(ctx)
+	}
+	return false, t.DoFunc()
+}
+
+// runAttempts runs the task func, retrying failures as configured, and
+// fills in the outcome of e. The backoff delays are measured on clock.
+func (t *Task) runAttempts(ctx context.Context, clock Clock, e *Execution) {
+	for {
+		e.Attempts++
+		e.Panic, e.Err = t.attempt(ctx)
+		if e.Err == nil || e.Attempts > t.retries {
+			return
+		}
+
+		delay, now := t.backoffDelay(e.Attempts), clock.Now()
+		if next := t.GetNext(); next.After(now) && !now.Add(delay).Before(next) {
+			e.Reason = joinReasons(e.Reason, "retry abandoned: next run due")
+			return
+		}
+		timer := clock.NewTimer(delay)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			e.Reason = joinReasons(e.Reason, "retry abandoned: scheduler stopped")
+			return
+		}
+	}
+}
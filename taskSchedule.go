@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// TaskSchedule describes when a task runs. Next returns the first run time
+// after t, or the zero time if the task will not run again. Schedule (cron
+// specs), Every, EveryWithJitter and At implement it.
+//
+// A task whose schedule returns the zero time after a run is removed from
+// its scheduler.
+type TaskSchedule interface {
+	Next(t time.Time) time.Time
+}
+
+// EverySchedule runs a task at a fixed interval, counted from the previous
+// run (or from the start of the scheduler for the first run).
+type EverySchedule struct {
+	Interval time.Duration
+	Jitter   time.Duration // upper bound of a random delay added to each run
+}
+
+// Every returns a schedule that runs every d. It panics if d is not
+// positive.
+func Every(d time.Duration) *EverySchedule {
+	return EveryWithJitter(d, 0)
+}
+
+// EveryWithJitter is like Every but delays each run by a random duration in
+// [0, j), to spread out tasks that would otherwise run in lockstep.
+func EveryWithJitter(d, j time.Duration) *EverySchedule {
+	if d <= 0 {
+		panic("utils: non-positive interval for Every")
+	}
+	if j < 0 {
+		j = 0
+	}
+	return &EverySchedule{Interval: d, Jitter: j}
+}
+
+// Next returns t plus the interval and a random jitter.
+func (s *EverySchedule) Next(t time.Time) time.Time {
+	next := t.Add(s.Interval)
+	if s.Jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(s.Jitter))))
+	}
+	return next
+}
+
+// alignedNext is like Next, but returns the first multiple of the interval
+// since the zero time after t, plus a random jitter. Schedulers sharing a
+// Locker plan the same runs this way, whenever they started.
+func (s *EverySchedule) alignedNext(t time.Time) time.Time {
+	return s.Next(t.Truncate(s.Interval))
+}
+
+// String returns the schedule as an @every spec.
+func (s *EverySchedule) String() string {
+	return "@every " + s.Interval.String()
+}
+
+// AtSchedule runs a task once.
+type AtSchedule struct {
+	Time time.Time
+}
+
+// At returns a schedule that runs once, at t.
+func At(t time.Time) *AtSchedule {
+	return &AtSchedule{Time: t}
+}
+
+// Next returns the run time if it is after t, and the zero time otherwise.
+func (s *AtSchedule) Next(t time.Time) time.Time {
+	if s.Time.After(t) {
+		return s.Time
+	}
+	return time.Time{}
+}
+
+// String returns the schedule as an @at spec.
+func (s *AtSchedule) String() string {
+	return "@at " + s.Time.Format(time.RFC3339)
+}
+
+// ParseTaskSchedule parses spec like ParseSchedule and also accepts
+// "@every <duration>", where duration is in time.ParseDuration format, e.g.
+// "@every 1h30m", and "@at <time>", where time is in RFC 3339 format, e.g.
+// "@at 2026-11-01T03:00:00+08:00".
+func ParseTaskSchedule(spec string) (TaskSchedule, error) {
+	if strings.HasPrefix(spec, "@at ") {
+		arg := strings.TrimSpace(spec[len("@at "):])
+		t, err := time.Parse(time.RFC3339, arg)
+		if err != nil {
+			return nil, &SpecError{Spec: spec, Field: "time", Pos: strings.Index(spec, arg),
+				Msg: fmt.Sprintf("invalid time %q, want RFC 3339 such as 2026-11-01T03:00:00Z", arg)}
+		}
+		return At(t), nil
+	}
+	if strings.HasPrefix(spec, "@every ") {
+		arg := strings.TrimSpace(spec[len("@every "):])
+		d, err := time.ParseDuration(arg)
+		if err != nil || d <= 0 {
+			return nil, &SpecError{Spec: spec, Field: "interval", Pos: strings.Index(spec, arg),
+				Msg: fmt.Sprintf("invalid duration %q, want a positive duration such as 1h30m", arg)}
+		}
+		return Every(d), nil
+	}
+	s, err := ParseSchedule(spec)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
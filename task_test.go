@@ -0,0 +1,1358 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSchedulerConcurrentRegistration(t *testing.T) {
+	s := NewScheduler()
+	s.Start(context.Background())
+	defer s.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				name := "task" + strconv.Itoa(i) + "-" + strconv.Itoa(j)
+				s.AddTask(name, NewTask(name, "0 0 0 * * *", func() error { return nil }))
+				if j%2 == 0 {
+					s.DeleteTask(name)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := len(s.Tasks()); n != 8*25 {
+		t.Errorf("len(Tasks()) = %d; want %d", n, 8*25)
+	}
+	for name, task := range s.Tasks() {
+		if task.GetNext().IsZero() {
+			t.Errorf("task %s added while running has no next time", name)
+		}
+	}
+}
+
+func TestAdminTaskListSnapshot(t *testing.T) {
+	tk := NewTask("snapshot", "0 0 0 * * *", func() error { return nil })
+	if err := AddTask("snapshot", tk); err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteTask("snapshot")
+	snapshot := AdminTaskList
+	if snapshot["snapshot"] != tk {
+		t.Fatalf("AdminTaskList = %v; want the added task", snapshot)
+	}
+
+	delete(snapshot, "snapshot")
+	if _, ok := DefaultScheduler.Task("snapshot"); !ok {
+		t.Error("changing AdminTaskList removed the task from DefaultScheduler")
+	}
+
+	DeleteTask("snapshot")
+	if _, ok := AdminTaskList["snapshot"]; ok {
+		t.Error("AdminTaskList still has the task after DeleteTask")
+	}
+	if _, ok := DefaultScheduler.Task("snapshot"); ok {
+		t.Error("DefaultScheduler still has the task after DeleteTask")
+	}
+}
+
+func TestSchedulerStopWaitsForRuns(t *testing.T) {
+	var started, finished int32
+	s := NewScheduler()
+	s.AddTask("slow", NewTask("slow", "* * * * * *", func() error {
+		atomic.AddInt32(&started, 1)
+		time.Sleep(200 * time.Millisecond)
+		atomic.AddInt32(&finished, 1)
+		return nil
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+	for atomic.LoadInt32(&started) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Stop()
+
+	if s.Running() {
+		t.Errorf("scheduler still running after Stop")
+	}
+	if atomic.LoadInt32(&finished) != atomic.LoadInt32(&started) {
+		t.Errorf("Stop returned before in-flight runs finished")
+	}
+}
+
+func TestSchedulerContextCancel(t *testing.T) {
+	s := NewScheduler()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	cancel()
+	for i := 0; i < 100 && s.Running(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if s.Running() {
+		t.Errorf("scheduler still running after its context was canceled")
+	}
+	s.Stop()
+}
+
+func TestScheduleTimeZone(t *testing.T) {
+	task := NewTask("tz", "CRON_TZ=Asia/Shanghai 0 0 9 * * *", func() error { return nil })
+	shanghai, _ := time.LoadLocation("Asia/Shanghai")
+
+	task.SetNext(time.Date(2026, 5, 1, 0, 30, 0, 0, time.UTC))
+	want := time.Date(2026, 5, 1, 9, 0, 0, 0, shanghai)
+	if next := task.GetNext(); !next.Equal(want) || next.Location() != time.UTC {
+		t.Errorf("next = %v; want %v in UTC", next, want.UTC())
+	}
+
+	task = NewTask("tz", "0 0 9 * * *", func() error { return nil })
+	task.Location = shanghai
+	task.SetNext(time.Date(2026, 5, 1, 0, 30, 0, 0, time.UTC))
+	if next := task.GetNext(); !next.Equal(want) {
+		t.Errorf("next with Task.Location = %v; want %v", next, want)
+	}
+}
+
+func TestScheduleDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		name, spec string
+		from       time.Time
+		want       []string
+	}{
+		{
+			name: "spring forward, fixed time in the gap",
+			spec: "TZ=America/New_York 0 30 2 * * *",
+			from: time.Date(2026, 3, 7, 12, 0, 0, 0, ny),
+			want: []string{"03-08 03:00 EDT", "03-09 02:30 EDT", "03-10 02:30 EDT"},
+		},
+		{
+			name: "spring forward, wildcard hour",
+			spec: "TZ=America/New_York 0 */30 * * * *",
+			from: time.Date(2026, 3, 8, 1, 0, 0, 0, ny),
+			want: []string{"03-08 01:30 EST", "03-08 03:00 EDT", "03-08 03:30 EDT"},
+		},
+		{
+			name: "fall back, fixed time in the overlap",
+			spec: "TZ=America/New_York 0 30 1 * * *",
+			from: time.Date(2026, 10, 31, 12, 0, 0, 0, ny),
+			want: []string{"11-01 01:30 EDT", "11-02 01:30 EST", "11-03 01:30 EST"},
+		},
+		{
+			name: "fall back, wildcard hour",
+			spec: "TZ=America/New_York 0 */30 * * * *",
+			from: time.Date(2026, 11, 1, 0, 45, 0, 0, ny),
+			want: []string{"11-01 01:00 EDT", "11-01 01:30 EDT", "11-01 01:00 EST", "11-01 01:30 EST", "11-01 02:00 EST"},
+		},
+	}
+	for _, tt := range tests {
+		task := NewTask(tt.name, tt.spec, func() error { return nil })
+		next := tt.from
+		for i, want := range tt.want {
+			next = task.Spec.Next(next)
+			if got := next.In(ny).Format("01-02 15:04 MST"); got != want {
+				t.Errorf("%s: fire %d = %s; want %s", tt.name, i, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	tests := []struct {
+		spec  string
+		field string
+		pos   int
+		msg   string
+	}{
+		{"0 0 24 * * *", "hour", 4, "value 24 out of range 0-23"},
+		{"0 0 0 0 * *", "day of month", 6, "value 0 out of range 1-31"},
+		{"0 61 0 * * *", "minute", 2, "value 61 out of range 0-59"},
+		{"0 0 0 * foo *", "month", 8, `invalid value "foo", want 1-12 or a name`},
+		{"0 0 0 * * 1-9", "day of week", 12, "value 9 out of range 0-6"},
+		{"0 */0 * * * *", "minute", 4, "step must be at least 1"},
+		{"0 0 5-2 * * *", "hour", 4, "range start 5 is beyond range end 2"},
+		{"0 0 1,,2 * * *", "hour", 6, "empty list element"},
+		{"0 0 0 1", "", 0, "expected 5 or 6 fields, found 4"},
+		{"TZ=Nowhere/Land 0 0 * * *", "time zone", 3, `unknown time zone "Nowhere/Land"`},
+		{"@fortnightly", "", 0, "unrecognized descriptor @fortnightly"},
+	}
+	for _, tt := range tests {
+		_, err := ParseSchedule(tt.spec)
+		se, ok := err.(*SpecError)
+		if !ok {
+			t.Errorf("ParseSchedule(%q) error = %v; want *SpecError", tt.spec, err)
+			continue
+		}
+		if se.Field != tt.field || se.Pos != tt.pos || se.Msg != tt.msg {
+			t.Errorf("ParseSchedule(%q) = {%q %d %q}; want {%q %d %q}",
+				tt.spec, se.Field, se.Pos, se.Msg, tt.field, tt.pos, tt.msg)
+		}
+	}
+}
+
+func TestNewTaskE(t *testing.T) {
+	if _, err := NewTaskE("bad", "0 0 25 * * *", func() error { return nil }); err == nil {
+		t.Fatal("NewTaskE with an invalid spec should fail")
+	}
+	task, err := NewTaskE("good", "0 30 * * * *", func() error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := task.SetSpec("0 0 0 32 * *"); err == nil {
+		t.Error("SetSpec with an invalid spec should fail")
+	}
+	equal(t, "0 30 * * * *", task.GetSpec())
+
+	defer func() {
+		if recover() == nil {
+			t.Error("NewTask with an invalid spec should panic")
+		}
+	}()
+	NewTask("bad", "*/0 * * * * *", func() error { return nil })
+}
+
+func TestScheduleDayModifiers(t *testing.T) {
+	lastDay := func(d time.Time) bool { return d.AddDate(0, 0, 1).Day() == 1 }
+	weekday := func(d time.Time) bool { return d.Weekday() != time.Saturday && d.Weekday() != time.Sunday }
+	// nearest is the weekday nearest to the 15th, found by looking at
+	// the 15th and its neighbours.
+	nearest := func(d time.Time) bool {
+		f := time.Date(d.Year(), d.Month(), 15, 0, 0, 0, 0, time.UTC)
+		switch f.Weekday() {
+		case time.Saturday:
+			f = f.AddDate(0, 0, -1)
+		case time.Sunday:
+			f = f.AddDate(0, 0, 1)
+		}
+		return d.Day() == f.Day()
+	}
+
+	tests := []struct {
+		spec  string
+		first []string // known-good leading fire times
+		match func(d time.Time) bool
+	}{
+		{"0 30 9 L * ?", []string{"2024-01-31", "2024-02-29", "2024-03-31", "2024-04-30"}, lastDay},
+		{"0 30 9 L-2 * ?", []string{"2024-01-29", "2024-02-27", "2024-03-29"}, func(d time.Time) bool {
+			return lastDay(d.AddDate(0, 0, 2))
+		}},
+		{"0 30 9 LW * ?", []string{"2024-01-31", "2024-02-29", "2024-03-29", "2024-04-30", "2024-05-31", "2024-06-28"}, func(d time.Time) bool {
+			if !weekday(d) {
+				return false
+			}
+			for n := d.AddDate(0, 0, 1); n.Month() == d.Month(); n = n.AddDate(0, 0, 1) {
+				if weekday(n) {
+					return false
+				}
+			}
+			return true
+		}},
+		{"0 30 9 15W * ?", []string{"2024-01-15", "2024-02-15", "2024-03-15", "2024-04-15", "2024-05-15", "2024-06-14", "2024-07-15", "2024-08-15", "2024-09-16"}, nearest},
+		{"0 30 9 1W * ?", []string{"2024-01-01", "2024-02-01", "2024-03-01", "2024-04-01", "2024-05-01", "2024-06-03"}, func(d time.Time) bool {
+			f := time.Date(d.Year(), d.Month(), 1, 0, 0, 0, 0, time.UTC)
+			for !weekday(f) {
+				f = f.AddDate(0, 0, 1)
+			}
+			return d.Day() == f.Day()
+		}},
+		{"0 30 9 ? * 2#2", []string{"2024-01-09", "2024-02-13", "2024-03-12", "2024-04-09"}, func(d time.Time) bool {
+			return d.Weekday() == time.Tuesday && d.Day() > 7 && d.Day() <= 14
+		}},
+		{"0 30 9 ? * MON#5", []string{"2024-01-29", "2024-04-29", "2024-07-29", "2024-09-30"}, func(d time.Time) bool {
+			return d.Weekday() == time.Monday && d.Day() > 28
+		}},
+		{"0 30 9 ? * 5L", []string{"2024-01-26", "2024-02-23", "2024-03-29"}, func(d time.Time) bool {
+			return d.Weekday() == time.Friday && d.AddDate(0, 0, 7).Month() != d.Month()
+		}},
+		{"0 30 9 1,L * ?", []string{"2024-01-01", "2024-01-31", "2024-02-01", "2024-02-29"}, func(d time.Time) bool {
+			return d.Day() == 1 || lastDay(d)
+		}},
+		{"0 30 9 L * 1#1", []string{"2024-01-01", "2024-01-31", "2024-02-05", "2024-02-29"}, func(d time.Time) bool {
+			return lastDay(d) || d.Weekday() == time.Monday && d.Day() <= 7
+		}},
+	}
+
+	start := time.Date(2023, 12, 31, 12, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.spec)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q): %v", tt.spec, err)
+			continue
+		}
+
+		var want []time.Time
+		for d := start.Truncate(24 * time.Hour); len(want) < 50; d = d.AddDate(0, 0, 1) {
+			if at := d.Add(9*time.Hour + 30*time.Minute); at.After(start) && tt.match(d) {
+				want = append(want, at)
+			}
+		}
+		for i, f := range tt.first {
+			if got := want[i].Format("2006-01-02"); got != f {
+				t.Fatalf("%s: oracle fire %d = %s; want %s", tt.spec, i, got, f)
+			}
+		}
+
+		next := start
+		for i, w := range want {
+			next = s.Next(next)
+			if !next.Equal(w) {
+				t.Errorf("%s: fire %d = %v; want %v", tt.spec, i, next, w)
+				break
+			}
+		}
+	}
+}
+
+func TestParseScheduleModifierErrors(t *testing.T) {
+	for _, spec := range []string{
+		"0 0 L * * *",
+		"0 0 0 32W * ?",
+		"0 0 0 L-31 * ?",
+		"0 0 0 ? * 2#6",
+		"0 0 0 ? * 8#1",
+		"0 0 0 ? * 7L",
+		"? 0 0 * * *",
+	} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("ParseSchedule(%q) should fail", spec)
+		}
+	}
+}
+
+func TestTaskSchedules(t *testing.T) {
+	from := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	every, err := ParseTaskSchedule("@every 1h30m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, from.Add(90*time.Minute), every.Next(from))
+	if _, err := ParseTaskSchedule("@every soon"); err == nil {
+		t.Error(`ParseTaskSchedule("@every soon") should fail`)
+	}
+
+	jitter := EveryWithJitter(time.Minute, 10*time.Second)
+	for i := 0; i < 100; i++ {
+		d := jitter.Next(from).Sub(from)
+		if d < time.Minute || d >= time.Minute+10*time.Second {
+			t.Fatalf("jittered interval %v out of [1m, 1m10s)", d)
+		}
+	}
+
+	at := At(from.Add(time.Hour))
+	equal(t, from.Add(time.Hour), at.Next(from))
+	if next := at.Next(from.Add(time.Hour)); !next.IsZero() {
+		t.Errorf("At.Next after the run time = %v; want zero", next)
+	}
+
+	task := NewScheduledTask("every", Every(time.Minute), func() error { return nil })
+	equal(t, "@every 1m0s", task.GetSpec())
+	task = NewScheduledTask("once", at, func() error { return nil })
+	parsed, err := ParseTaskSchedule(task.GetSpec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, at.Next(from), parsed.Next(from))
+}
+
+func TestSchedulerRemovesFinishedTasks(t *testing.T) {
+	s := NewScheduler()
+	ran := make(chan struct{}, 1)
+	s.AddTask("once", NewScheduledTask("once", At(time.Now().Add(20*time.Millisecond)), func() error {
+		ran <- struct{}{}
+		return nil
+	}))
+	s.AddTask("every", NewScheduledTask("every", Every(time.Hour), func() error { return nil }))
+	s.Start(context.Background())
+	defer s.Stop()
+
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatal("one-shot task did not run")
+	}
+	for deadline := time.Now().Add(time.Second); ; {
+		if _, ok := s.Task("once"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("finished one-shot task was not removed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, ok := s.Task("every"); !ok {
+		t.Error("interval task should stay registered")
+	}
+}
+
+// valueTask is a Tasker that is a non-comparable value, so it can be
+// neither a map key nor compared with ==.
+type valueTask struct {
+	labels []string
+	times  *[2]time.Time // next, prev
+	runs   chan struct{}
+}
+
+func (v valueTask) GetSpec() string        { return "@every 1m" }
+func (v valueTask) GetStatus() string      { return "" }
+func (v valueTask) Run() error             { v.runs <- struct{}{}; return nil }
+func (v valueTask) SetNext(now time.Time)  { v.times[0] = now.Add(time.Minute) }
+func (v valueTask) GetNext() time.Time     { return v.times[0] }
+func (v valueTask) SetPrev(prev time.Time) { v.times[1] = prev }
+func (v valueTask) GetPrev() time.Time     { return v.times[1] }
+
+func TestSchedulerValueTask(t *testing.T) {
+	clock := NewFakeClock(time.Date(2001, 3, 5, 0, 0, 0, 0, time.Local))
+	s := NewScheduler(WithClock(clock))
+	task := valueTask{labels: []string{"a"}, times: new([2]time.Time), runs: make(chan struct{}, 2)}
+	s.AddTask("value", task)
+	s.Start(context.Background())
+	defer s.Stop()
+
+	for i := 0; i < 2; i++ {
+		clock.BlockUntil(1)
+		clock.Advance(time.Minute)
+		select {
+		case <-task.runs:
+		case <-time.After(time.Second):
+			t.Fatalf("run %d of the value task did not happen", i+1)
+		}
+	}
+}
+
+// concurrencyProbe counts runs in progress and remembers the maximum.
+type concurrencyProbe struct {
+	mu       sync.Mutex
+	cur, max int
+	runs     int
+	sleep    time.Duration
+}
+
+func (p *concurrencyProbe) run() error {
+	p.mu.Lock()
+	p.cur++
+	p.runs++
+	if p.cur > p.max {
+		p.max = p.cur
+	}
+	p.mu.Unlock()
+	time.Sleep(p.sleep)
+	p.mu.Lock()
+	p.cur--
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *concurrencyProbe) stats() (max, runs int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.max, p.runs
+}
+
+func TestSchedulerOverlapPolicy(t *testing.T) {
+	for _, policy := range []OverlapPolicy{OverlapAllow, OverlapSkip, OverlapQueue} {
+		probe := &concurrencyProbe{sleep: 35 * time.Millisecond}
+		task := NewScheduledTask("slow", Every(10*time.Millisecond), probe.run)
+		task.Overlap = policy
+
+		s := NewScheduler()
+		s.AddTask("slow", task)
+		s.Start(context.Background())
+		time.Sleep(100 * time.Millisecond)
+		s.Stop()
+
+		max, runs := probe.stats()
+		status := task.GetStatus()
+		switch policy {
+		case OverlapAllow:
+			if max < 2 {
+				t.Errorf("%v: max concurrent runs = %d; want overlapping runs", policy, max)
+			}
+		case OverlapSkip:
+			if max != 1 || !strings.Contains(status, "skipped: previous run still in progress") {
+				t.Errorf("%v: max concurrent runs = %d, status %q; want 1 and skipped runs", policy, max, status)
+			}
+		case OverlapQueue:
+			if max != 1 || runs < 2 || !hasReason(task, "queued: previous run still in progress") ||
+				!strings.Contains(status, "skipped: a run is already queued") {
+				t.Errorf("%v: max concurrent runs = %d, runs %d, status %q; want 1, queued and skipped runs", policy, max, runs, status)
+			}
+		}
+	}
+}
+
+func TestSchedulerMaxConcurrency(t *testing.T) {
+	probe := &concurrencyProbe{sleep: 20 * time.Millisecond}
+	s := NewScheduler(WithMaxConcurrency(1))
+	var tasks []*Task
+	for _, name := range []string{"a", "b", "c"} {
+		task := NewScheduledTask(name, Every(10*time.Millisecond), probe.run)
+		tasks = append(tasks, task)
+		s.AddTask(name, task)
+	}
+	s.Start(context.Background())
+	time.Sleep(80 * time.Millisecond)
+	s.Stop()
+
+	if max, runs := probe.stats(); max != 1 || runs == 0 {
+		t.Errorf("max concurrent runs = %d after %d runs; want 1", max, runs)
+	}
+	var queued bool
+	for _, task := range tasks {
+		queued = queued || hasReason(task, "queued: scheduler at max concurrency")
+	}
+	if !queued {
+		t.Error("runs waiting for a slot should be recorded")
+	}
+}
+
+// hasReason reports whether an execution of task was skipped or delayed for
+// reason.
+func hasReason(task *Task, reason string) bool {
+	for _, e := range task.History() {
+		if strings.Contains(e.Reason, reason) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTaskHistory(t *testing.T) {
+	n := 0
+	task := NewScheduledTask("flaky", Every(time.Minute), func() error {
+		n++
+		if n%2 == 0 {
+			return errors.New("even run " + strconv.Itoa(n))
+		}
+		return nil
+	})
+	task.HistoryLimit = 3
+	task.ErrLimit = 2
+
+	before := time.Now()
+	for i := 0; i < 6; i++ {
+		task.Run()
+	}
+	task.recordSkip(before, "previous run still in progress")
+
+	h := task.History()
+	if len(h) != 3 {
+		t.Fatalf("len(History()) = %d; want 3", len(h))
+	}
+	if h[0].Err != nil || h[1].Err == nil || h[1].Err.Error() != "even run 6" || !h[2].Skipped {
+		t.Errorf("History() = %+v; want the last two runs and the skip, oldest first", h)
+	}
+	if h[1].Start.Before(before) || h[1].End.Before(h[1].Start) || h[1].Duration != h[1].End.Sub(h[1].Start) {
+		t.Errorf("run times = %v, %v, %v; want start, end and duration", h[1].Start, h[1].End, h[1].Duration)
+	}
+
+	// ErrList rotates and records the failure time.
+	if len(task.ErrList) != 2 || task.ErrList[0].errInfo != "even run 4" || task.ErrList[1].errInfo != "even run 6" {
+		t.Errorf("ErrList = %v; want the last two errors", task.ErrList)
+	}
+	equal(t, h[1].End, task.ErrList[1].t)
+
+	status := task.GetStatus()
+	if !strings.Contains(status, "even run 6") || !strings.Contains(status, "skipped: previous run still in progress") {
+		t.Errorf("GetStatus() = %q; want the failed and skipped runs", status)
+	}
+
+	b, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded []map[string]interface{}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	equal(t, "even run 6", decoded[1]["error"])
+	equal(t, true, decoded[2]["skipped"])
+	if _, ok := decoded[2]["start"]; ok {
+		t.Errorf("skipped run should have no start time: %s", b)
+	}
+}
+
+func TestExecutionRingLimit(t *testing.T) {
+	var r executionRing
+	add := func(limit int, from, to int) {
+		for i := from; i <= to; i++ {
+			r.add(Execution{Attempts: i}, limit)
+		}
+	}
+	order := func() []int {
+		var got []int
+		for _, e := range r.list() {
+			got = append(got, e.Attempts)
+		}
+		return got
+	}
+	add(3, 1, 5)
+	equal(t, []int{3, 4, 5}, order())
+	add(5, 6, 8) // raised after wrapping
+	equal(t, []int{4, 5, 6, 7, 8}, order())
+	add(2, 9, 9) // lowered
+	equal(t, []int{8, 9}, order())
+}
+
+func TestTaskRecoverTimeoutRetry(t *testing.T) {
+	task := NewTask("panics", "0 0 0 * * *", func() error { panic("boom") }, WithRecover())
+	if err := task.Run(); err == nil || err.Error() != "panic: boom" {
+		t.Errorf("Run() = %v; want the recovered panic", err)
+	}
+	if h := task.History(); len(h) != 1 || !h[0].Panic {
+		t.Errorf("History() = %+v; want a panicked run", h)
+	}
+
+	task, err := NewTaskCtx("slow", "0 0 0 * * *", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, WithTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := task.Run(); err != context.DeadlineExceeded {
+		t.Errorf("Run() = %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	calls := 0
+	task = NewTask("flaky", "0 0 0 * * *", func() error {
+		if calls++; calls < 3 {
+			return errors.New("not yet")
+		}
+		return nil
+	}, WithRetry(3, time.Millisecond, 4*time.Millisecond))
+	if err := task.Run(); err != nil {
+		t.Errorf("Run() = %v; want success on the third attempt", err)
+	}
+	if h := task.History(); len(h) != 1 || h[0].Attempts != 3 || h[0].Err != nil {
+		t.Errorf("History() = %+v; want one successful run after 3 attempts", h)
+	}
+
+	// A retry that would run into the next fire is given up.
+	task = NewTask("failing", "0 0 0 * * *", func() error { return errors.New("down") },
+		WithRetry(5, 50*time.Millisecond, 0))
+	task.Next = time.Now().Add(20 * time.Millisecond)
+	task.Run()
+	if h := task.History(); len(h) != 1 || h[0].Attempts != 1 || h[0].Reason != "retry abandoned: next run due" {
+		t.Errorf("History() = %+v; want a single attempt and an abandoned retry", h)
+	}
+}
+
+func TestTaskBackoffDelay(t *testing.T) {
+	task := NewTask("backoff", "0 0 0 * * *", nil, WithRetry(10, 100*time.Millisecond, time.Second))
+	for n, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			if d := task.backoffDelay(n + 1); d > max || d < max/2 {
+				t.Fatalf("backoffDelay(%d) = %v; want in [%v, %v]", n+1, d, max/2, max)
+			}
+		}
+	}
+
+	// Without a maximum the delay grows until it would overflow.
+	task = NewTask("backoff", "0 0 0 * * *", nil, WithRetry(100, time.Second, 0))
+	for n := 1; n <= 100; n++ {
+		if d := task.backoffDelay(n); d < time.Second/2 {
+			t.Fatalf("backoffDelay(%d) = %v without maxBackoff; want at least 500ms", n, d)
+		}
+	}
+}
+
+func TestFileStateStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "tasks.json")
+	last := time.Date(2026, 10, 1, 3, 0, 0, 0, time.UTC)
+
+	if got, err := NewFileStateStore(path).Load("report"); err != nil || !got.IsZero() {
+		t.Fatalf("Load from a missing file = %v, %v; want zero, nil", got, err)
+	}
+	if err := NewFileStateStore(path).Save("report", last); err != nil {
+		t.Fatal(err)
+	}
+	got, err := NewFileStateStore(path).Load("report")
+	if err != nil || !got.Equal(last) {
+		t.Errorf("Load() = %v, %v; want %v, nil", got, err, last)
+	}
+
+	// Stores of several schedulers save to the same file at once; the
+	// file is always whole.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		store := NewFileStateStore(path)
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				for k := 0; k < 10; k++ {
+					if err := store.Save(name, last); err != nil {
+						t.Error(err)
+						return
+					}
+					if _, err := NewFileStateStore(path).Load(name); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}("task" + strconv.Itoa(i) + "-" + strconv.Itoa(j))
+		}
+	}
+	wg.Wait()
+	if files, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*")); len(files) != 1 {
+		t.Errorf("files after concurrent saves = %v; want only %s", files, path)
+	}
+}
+
+func TestSchedulerMisfire(t *testing.T) {
+	tests := []struct {
+		policy MisfirePolicy
+		runs   int
+		limit  bool // whether a skip for exceeding the misfire limit is recorded
+	}{
+		{MisfireSkip, 0, false},
+		{MisfireRunOnce, 1, false},
+		{MisfireRunAll, 3, true},
+	}
+	for _, tt := range tests {
+		store := NewFileStateStore(filepath.Join(t.TempDir(), "tasks.json"))
+		// Five runs were missed while the scheduler was down.
+		if err := store.Save("report", time.Now().Add(-5*time.Minute-30*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+
+		var runs int32
+		task := NewScheduledTask("report", Every(time.Minute), func() error {
+			atomic.AddInt32(&runs, 1)
+			return nil
+		}, WithMisfire(tt.policy, 3))
+		s := NewScheduler(WithStateStore(store))
+		s.AddTask("report", task)
+		s.Start(context.Background())
+		time.Sleep(50 * time.Millisecond)
+		s.Stop()
+
+		if n := int(atomic.LoadInt32(&runs)); n != tt.runs {
+			t.Errorf("%v: %d runs; want %d", tt.policy, n, tt.runs)
+		}
+		if got := hasReason(task, "more runs missed than the misfire limit"); got != tt.limit {
+			t.Errorf("%v: limit skip recorded = %v; want %v", tt.policy, got, tt.limit)
+		}
+		if tt.runs > 0 {
+			h := task.History()
+			last, _ := store.Load("report")
+			if !last.Equal(h[len(h)-1].Planned) {
+				t.Errorf("%v: saved last run %v; want %v", tt.policy, last, h[len(h)-1].Planned)
+			}
+		}
+	}
+}
+
+func testLocker(t *testing.T, l Locker) {
+	token, ok, err := l.Acquire("job@1", 50*time.Millisecond)
+	if err != nil || !ok {
+		t.Fatalf("Acquire() = %v, %v; want the lease", ok, err)
+	}
+	if _, ok, err := l.Acquire("job@1", time.Second); err != nil || ok {
+		t.Fatalf("second Acquire() = %v, %v; want the lease to be held", ok, err)
+	}
+	if err := l.Renew("job@1", "someone else", time.Second); err != ErrLeaseLost {
+		t.Errorf("Renew() with a foreign token = %v; want ErrLeaseLost", err)
+	}
+	if err := l.Renew("job@1", token, 50*time.Millisecond); err != nil {
+		t.Errorf("Renew() = %v", err)
+	}
+	if err := l.Release("job@1", token); err != nil {
+		t.Errorf("Release() = %v", err)
+	}
+	if err := l.Release("job@1", token); err != ErrLeaseLost {
+		t.Errorf("second Release() = %v; want ErrLeaseLost", err)
+	}
+
+	token, ok, _ = l.Acquire("job@2", 10*time.Millisecond)
+	if !ok {
+		t.Fatal("Acquire() of a free lease failed")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := l.Renew("job@2", token, time.Second); err != ErrLeaseLost {
+		t.Errorf("Renew() of an expired lease = %v; want ErrLeaseLost", err)
+	}
+	if _, ok, _ := l.Acquire("job@2", time.Second); !ok {
+		t.Error("Acquire() of an expired lease failed")
+	}
+}
+
+// lateClock is a FakeClock whose timers fire late, as if the process had
+// been suspended.
+type lateClock struct {
+	*FakeClock
+	late time.Duration
+}
+
+func (c lateClock) NewTimer(d time.Duration) ClockTimer {
+	return c.FakeClock.NewTimer(d + c.late)
+}
+
+func TestSchedulerLateRuns(t *testing.T) {
+	start := time.Date(2001, 3, 5, 0, 0, 0, 0, time.Local)
+	clock := NewFakeClock(start)
+	s := NewScheduler(WithClock(lateClock{clock, 5 * time.Second}))
+	plain := NewScheduledTask("plain", Every(time.Minute), func() error { return nil })
+	skip := NewScheduledTask("skip", Every(time.Minute), func() error { return nil }, WithMisfire(MisfireSkip, 0))
+	s.AddTask("plain", plain)
+	s.AddTask("skip", skip)
+	s.Start(context.Background())
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute + 5*time.Second)
+	clock.BlockUntil(1) // the run loop is done with the late runs
+	s.Stop()
+
+	if h := plain.History(); len(h) != 1 || h[0].Skipped || !h[0].Planned.Equal(start.Add(time.Minute)) {
+		t.Errorf("task without a misfire policy: history %+v; want one run planned at %v", h, start.Add(time.Minute))
+	}
+	if h := skip.History(); len(h) != 1 || !h[0].Skipped || !strings.HasPrefix(h[0].Reason, "misfire:") {
+		t.Errorf("MisfireSkip task: history %+v; want one misfire skip", h)
+	}
+}
+
+func TestSchedulerMisfireOverlap(t *testing.T) {
+	var runs int32
+	task := NewScheduledTask("report", Every(time.Minute), func() error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	}, WithMisfire(MisfireRunAll, 3), WithOverlap(OverlapSkip))
+	s := NewScheduler()
+	s.AddTask("report", task)
+
+	// A run is in progress while missed runs are made up for.
+	s.mu.Lock()
+	s.state("report").running++
+	s.mu.Unlock()
+	now := time.Now()
+	s.misfired(context.Background(), "report", task, now.Add(-2*time.Minute), now, "test")
+	s.wg.Wait()
+
+	if n := atomic.LoadInt32(&runs); n != 0 {
+		t.Errorf("%d missed runs made up for during a run; want 0 with OverlapSkip", n)
+	}
+	if h := task.History(); len(h) != 3 || !hasReason(task, "previous run still in progress") {
+		t.Errorf("history %+v; want 3 runs skipped for the run in progress", h)
+	}
+}
+
+func TestMemoryLocker(t *testing.T) {
+	testLocker(t, NewMemoryLocker())
+}
+
+func TestSchedulerLockerEvery(t *testing.T) {
+	start := time.Date(2001, 3, 5, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	locker := NewMemoryLockerWithClock(clock)
+	var mu sync.Mutex
+	runs := make(map[time.Time]int)
+
+	// Replicas started at different times plan the same runs.
+	var schedulers []*Scheduler
+	done := make(chan Event, 3)
+	hooks := Hooks{
+		OnSuccess: func(e Event) { done <- e },
+		OnSkip:    func(e Event) { done <- e },
+	}
+	for i := 0; i < 3; i++ {
+		s := NewScheduler(WithClock(clock), WithLocker(locker, 30*time.Second), WithHooks(hooks))
+		task := NewScheduledTask("tick", Every(time.Minute), nil)
+		task.DoFunc = func() error {
+			mu.Lock()
+			runs[task.GetPrev()]++
+			mu.Unlock()
+			return nil
+		}
+		s.AddTask("tick", task)
+		s.Start(context.Background())
+		schedulers = append(schedulers, s)
+		clock.Advance(17 * time.Second)
+	}
+	clock.Advance(9 * time.Second) // to the first minute
+	for i := 0; i < 5; i++ {
+		// Each replica runs or skips the occurrence before the next one.
+		for range schedulers {
+			<-done
+		}
+		if i < 4 {
+			clock.BlockUntil(len(schedulers))
+			clock.Advance(time.Minute)
+		}
+	}
+	for _, s := range schedulers {
+		s.Stop()
+	}
+
+	if len(runs) != 5 {
+		t.Errorf("%d occurrences ran; want 5", len(runs))
+	}
+	for planned, n := range runs {
+		if n != 1 || planned.Truncate(time.Minute) != planned {
+			t.Errorf("occurrence %v ran %d times; want once, on the minute", planned, n)
+		}
+	}
+}
+
+func TestSchedulerLockerFakeClock(t *testing.T) {
+	start := time.Date(2001, 3, 5, 0, 0, 0, 0, time.Local)
+	clock := NewFakeClock(start)
+	locker := NewMemoryLockerWithClock(clock)
+	s := NewScheduler(WithClock(clock), WithLocker(locker, 30*time.Second))
+	started, finish := make(chan struct{}), make(chan struct{})
+	s.AddTask("slow", NewScheduledTask("slow", Every(time.Hour), func() error {
+		close(started)
+		<-finish
+		return nil
+	}))
+	s.Start(context.Background())
+	defer s.Stop()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Hour)
+	<-started
+	lease := lockName("slow", start.Add(time.Hour))
+	// The lease is renewed on the fake clock for as long as the run takes,
+	// well past its TTL.
+	for i := 0; i < 12; i++ {
+		clock.BlockUntil(2) // the next run and the renewal
+		clock.Advance(10 * time.Second)
+		if _, ok, _ := locker.Acquire(lease, time.Second); ok {
+			t.Fatalf("lease free %v into the run; want it renewed", time.Duration(i+1)*10*time.Second)
+		}
+	}
+	clock.BlockUntil(2) // the last renewal is done
+	close(finish)
+	for clock.Pending() != 1 {
+		time.Sleep(time.Millisecond) // the renewal stops with the run
+	}
+
+	// A successful run keeps its lease until it expires.
+	clock.Advance(29 * time.Second)
+	if _, ok, _ := locker.Acquire(lease, time.Second); ok {
+		t.Error("lease free before its TTL passed")
+	}
+	clock.Advance(2 * time.Second)
+	if _, ok, _ := locker.Acquire(lease, time.Second); !ok {
+		t.Error("lease still held after its TTL passed")
+	}
+}
+
+func TestSchedulerLocker(t *testing.T) {
+	locker := NewMemoryLocker()
+	if s := NewScheduler(WithLocker(locker, 0)); s.lockTTL != DefaultLockTTL {
+		t.Errorf("lock TTL = %v for ttl 0; want DefaultLockTTL", s.lockTTL)
+	}
+	var mu sync.Mutex
+	runs := make(map[time.Time]int)
+
+	var schedulers []*Scheduler
+	for i := 0; i < 3; i++ {
+		s := NewScheduler(WithLocker(locker, time.Minute))
+		task := NewTask("tick", "* * * * * *", nil)
+		task.DoFunc = func() error {
+			mu.Lock()
+			runs[task.GetPrev()]++
+			mu.Unlock()
+			return nil
+		}
+		s.AddTask("tick", task)
+		schedulers = append(schedulers, s)
+	}
+	for _, s := range schedulers {
+		s.Start(context.Background())
+	}
+	time.Sleep(1500 * time.Millisecond)
+	for _, s := range schedulers {
+		s.Stop()
+	}
+
+	if len(runs) == 0 {
+		t.Fatal("no occurrence ran")
+	}
+	for planned, n := range runs {
+		if n != 1 {
+			t.Errorf("occurrence %v ran %d times; want once", planned, n)
+		}
+	}
+}
+
+func TestSchedulerDependencies(t *testing.T) {
+	s := NewScheduler()
+	var mu sync.Mutex
+	var order []string
+	running, maxRunning := 0, 0
+	step := func(name string, fail bool) TaskFunc {
+		return func() error {
+			mu.Lock()
+			order = append(order, name)
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			if fail {
+				return errors.New(name + " broke")
+			}
+			return nil
+		}
+	}
+
+	export := NewScheduledTask("export", At(time.Now().Add(20*time.Millisecond)), step("export", false))
+	aggregate := NewScheduledTask("aggregate", nil, step("aggregate", false), WithDependsOn("export"))
+	archive := NewScheduledTask("archive", nil, step("archive", true), WithDependsOn("export"))
+	notify := NewScheduledTask("notify", nil, step("notify", false), WithDependsOn("aggregate", "archive"))
+	for _, task := range []*Task{notify, aggregate, archive, export} {
+		if err := s.AddTask(task.TaskName, task); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// export -> aggregate -> notify -> export would be a cycle.
+	cyclic := NewScheduledTask("export", Every(time.Hour), step("export", false), WithDependsOn("notify"))
+	if err := s.AddTask("export", cyclic); !errors.Is(err, ErrDependencyCycle) {
+		t.Errorf("AddTask() of a cyclic dependency = %v; want ErrDependencyCycle", err)
+	}
+	if err := s.AddTask("self", NewScheduledTask("self", nil, nil, WithDependsOn("self"))); !errors.Is(err, ErrDependencyCycle) {
+		t.Errorf("AddTask() of a self dependency = %v; want ErrDependencyCycle", err)
+	}
+
+	s.Start(context.Background())
+	for deadline := time.Now().Add(2 * time.Second); len(notify.History()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("notify was neither run nor skipped")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	s.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != 3 || order[0] != "export" || maxRunning != 2 {
+		t.Errorf("runs %v with at most %d at once; want export, then aggregate and archive in parallel", order, maxRunning)
+	}
+	h := notify.History()
+	if len(h) != 1 || !h[0].Skipped || h[0].Reason != "upstream archive failed: archive broke" {
+		t.Errorf("notify history = %+v; want a skip because archive failed", h)
+	}
+}
+
+func TestScheduleString(t *testing.T) {
+	tests := []struct {
+		spec, want string
+	}{
+		{"0 2 8-20/3 * * *", "0 2 8-20/3 * * *"},
+		{"*/5 * * * *", "*/5 * * * * *"},
+		{"0 0,10,20,30,40,50 * * * *", "0 0-50/10 * * * *"},
+		{"0 5/15 1-3,7 * jan,jul mon-fri", "0 5-50/15 1-3,7 * 1,7 1-5"},
+		{"0 0 0 L,LW,L-3,15W * ?", "0 0 0 L,L-3,LW,15W * *"},
+		{"0 0 0 ? * 2#2,FRIL", "0 0 0 * * 2#2,5L"},
+		{"0 */10,5 * * * *", "0 */10,5 * * * *"},
+		{"@daily", "0 0 0 * * *"},
+		{"CRON_TZ=Asia/Shanghai 0 0 9 * * *", "CRON_TZ=Asia/Shanghai 0 0 9 * * *"},
+	}
+	for _, tt := range tests {
+		s := MustParseSchedule(tt.spec)
+		got := s.String()
+		if got != tt.want {
+			t.Errorf("ParseSchedule(%q).String() = %q; want %q", tt.spec, got, tt.want)
+		}
+		back := MustParseSchedule(got)
+		if back.String() != got {
+			t.Errorf("String() of %q does not round-trip: %q", got, back.String())
+		}
+		from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+		if a, b := s.NextN(from, 20), back.NextN(from, 20); !reflect.DeepEqual(a, b) {
+			t.Errorf("%q and %q fire at different times: %v, %v", tt.spec, got, a, b)
+		}
+	}
+}
+
+func TestScheduleDescribe(t *testing.T) {
+	tests := []struct {
+		spec, want string
+	}{
+		{"0 2 8-20/3 * * *", "at second 0, minute 2, every 3 hours from 8 through 20"},
+		{"* * * * * *", "every second"},
+		{"0 * 1 * * *", "at second 0, every minute of hour 1"},
+		{"0 */10 * * * *", "at second 0 of every 10th minute"},
+		{"*/5 * * * * *", "every 5 seconds"},
+		{"*/5 0 * * * *", "every 5 seconds of minute 0"},
+		{"*/15 */2 * * * *", "every 15 seconds of every 2nd minute"},
+		{"* */2 * * * *", "every second of every 2nd minute"},
+		{"0 */2 */3 * * *", "at second 0 of every 2nd minute of every 3rd hour"},
+		{"0 0 0 */2 * *", "at second 0, minute 0, hour 0, every 2 days of the month"},
+		{"0 0 0 1 */3 *", "at second 0, minute 0, hour 0, on day 1 of the month, every 3 months"},
+		{"0 0,30 9-17 * * mon-fri", "at second 0, minutes 0 and 30, hours 9 through 17, on Monday through Friday"},
+		{"0 0 0 1,15 * 1", "at second 0, minute 0, hour 0, on days 1 and 15 of the month or on Monday"},
+		{"0 0 0 L * ?", "at second 0, minute 0, hour 0, on the last day of the month"},
+		{"0 0 0 15W jan,jul ?", "at second 0, minute 0, hour 0, on the weekday nearest day 15 of the month, in January and July"},
+		{"0 30 9 ? * 2#2", "at second 0, minute 30, hour 9, on the second Tuesday of the month"},
+		{"CRON_TZ=Asia/Shanghai 0 0 9 * * *", "at second 0, minute 0, hour 9, Asia/Shanghai time"},
+	}
+	for _, tt := range tests {
+		if got := MustParseSchedule(tt.spec).Describe(); got != tt.want {
+			t.Errorf("Describe(%q) = %q; want %q", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestScheduleNextN(t *testing.T) {
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	got := MustParseSchedule("0 2 8-20/3 * * *").NextN(from, 6)
+	want := []time.Time{
+		time.Date(2026, 1, 1, 8, 2, 0, 0, time.UTC),
+		time.Date(2026, 1, 1, 11, 2, 0, 0, time.UTC),
+		time.Date(2026, 1, 1, 14, 2, 0, 0, time.UTC),
+		time.Date(2026, 1, 1, 17, 2, 0, 0, time.UTC),
+		time.Date(2026, 1, 1, 20, 2, 0, 0, time.UTC),
+		time.Date(2026, 1, 2, 8, 2, 0, 0, time.UTC),
+	}
+	equal(t, want, got)
+	if n := len(MustParseSchedule("0 0 0 30 2 *").NextN(from, 3)); n != 0 {
+		t.Errorf("NextN of a schedule that never fires returned %d times", n)
+	}
+}
+
+func TestScheduleSparse(t *testing.T) {
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	// The fifth Monday of February only comes with a leap day on Monday.
+	sched := MustParseSchedule("0 0 0 ? 2 1#5")
+	equal(t, []time.Time{
+		time.Date(2044, 2, 29, 0, 0, 0, 0, time.UTC),
+		time.Date(2072, 2, 29, 0, 0, 0, 0, time.UTC),
+	}, sched.NextN(from, 2))
+	equal(t, time.Date(2016, 2, 29, 0, 0, 0, 0, time.UTC), sched.Prev(from))
+
+	never := MustParseSchedule("0 0 0 30 2 *")
+	if next, prev := never.Next(from), never.Prev(from); !next.IsZero() || !prev.IsZero() {
+		t.Errorf("schedule that never fires: Next = %v, Prev = %v", next, prev)
+	}
+}
+
+func TestSchedulePrev(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		spec       string
+		from, want time.Time
+	}{
+		{"0 2 8-20/3 * * *", time.Date(2026, 1, 2, 8, 2, 0, 0, time.UTC), time.Date(2026, 1, 1, 20, 2, 0, 0, time.UTC)},
+		{"0 2 8-20/3 * * *", time.Date(2026, 1, 2, 8, 2, 1, 0, time.UTC), time.Date(2026, 1, 2, 8, 2, 0, 0, time.UTC)},
+		{"0 0 0 L * ?", time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC), time.Date(2026, 2, 28, 0, 0, 0, 0, time.UTC)},
+		{"0 30 9 ? * 2#2", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 12, 9, 9, 30, 0, 0, time.UTC)},
+
+		// 02:30 is skipped by the spring-forward gap and fires at 03:00.
+		{"0 30 2 * * *", time.Date(2026, 3, 8, 4, 0, 0, 0, ny), time.Date(2026, 3, 8, 3, 0, 0, 0, ny)},
+		// 01:30 is repeated by the fall-back overlap and fires the first time.
+		{"0 30 1 * * *", time.Date(2026, 11, 1, 1, 45, 0, 0, ny).Add(time.Hour), time.Date(2026, 11, 1, 1, 30, 0, 0, ny)},
+		// With a wildcard hour both passes through the overlap fire.
+		{"0 */20 * * * *", time.Date(2026, 11, 1, 1, 10, 0, 0, ny).Add(time.Hour), time.Date(2026, 11, 1, 1, 0, 0, 0, ny).Add(time.Hour)},
+	}
+	for _, tt := range tests {
+		if got := MustParseSchedule(tt.spec).Prev(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%s: Prev(%v) = %v; want %v", tt.spec, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestScheduleNextLeapYearEnd(t *testing.T) {
+	// Past the end of the tz transition table, ZoneBounds is wrong on the
+	// last day of leap years.
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2044, 12, 31, 12, 0, 0, 0, ny)
+	equal(t, time.Date(2044, 12, 31, 12, 20, 0, 0, ny).String(), MustParseSchedule("0 */20 * * * *").Next(from).String())
+}
+
+func TestSchedulerFakeClockDay(t *testing.T) {
+	start := time.Date(2001, 3, 5, 0, 0, 0, 0, time.Local)
+	clock := NewFakeClock(start)
+	s := NewScheduler(WithClock(clock))
+	quarterly := NewTask("quarterly", "0 */15 * * * *", func() error { return nil })
+	hourly := NewTask("hourly", "0 0 * * * *", func() error { return nil })
+	s.AddTask("quarterly", quarterly)
+	s.AddTask("hourly", hourly)
+	s.Start(context.Background())
+
+	end := start.AddDate(0, 0, 1)
+	for clock.Now().Before(end) {
+		clock.BlockUntil(1)
+		clock.Advance(15 * time.Minute)
+	}
+	clock.BlockUntil(1) // the run loop is done with the last runs
+	s.Stop()
+
+	check := func(task *Task, every time.Duration, n int) {
+		hist := task.History()
+		if len(hist) != n {
+			t.Fatalf("%s ran %d times; want %d", task.TaskName, len(hist), n)
+		}
+		sort.Slice(hist, func(i, j int) bool { return hist[i].Planned.Before(hist[j].Planned) })
+		for i, e := range hist {
+			if want := start.Add(time.Duration(i+1) * every); !e.Planned.Equal(want) {
+				t.Errorf("%s run %d planned at %v; want %v", task.TaskName, i, e.Planned, want)
+			}
+			if e.Start.Before(e.Planned) || e.Start.After(end) {
+				t.Errorf("%s run %d started at %v, not on the fake clock", task.TaskName, i, e.Start)
+			}
+		}
+	}
+	check(quarterly, 15*time.Minute, 96)
+	check(hourly, time.Hour, 24)
+	if next := hourly.GetNext(); !next.Equal(end.Add(time.Hour)) {
+		t.Errorf("hourly next run at %v; want %v", next, end.Add(time.Hour))
+	}
+}
+
+func TestSchedulerHooks(t *testing.T) {
+	start := time.Date(2001, 3, 5, 0, 0, 0, 0, time.Local)
+	clock := NewFakeClock(start)
+	var mu sync.Mutex
+	var failures []Event
+	ended := make(chan string, 10)
+	s := NewScheduler(WithClock(clock), WithHooks(Hooks{
+		OnSuccess: func(e Event) { ended <- e.Task },
+		OnFailure: func(e Event) {
+			mu.Lock()
+			failures = append(failures, e)
+			mu.Unlock()
+			ended <- e.Task
+		},
+	}))
+	var calls int32
+	up := NewTask("up", "0 * * * * *", func() error {
+		if atomic.AddInt32(&calls, 1) == 2 {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	down := NewScheduledTask("down", nil, func() error { return nil }, WithDependsOn("up"))
+	s.AddTask("up", up)
+	s.AddTask("down", down)
+	s.Start(context.Background())
+	// Let the runs of each minute end before the next, so that the
+	// second run of up is the one that fails.
+	for _, runs := range []int{2, 1} {
+		clock.BlockUntil(1)
+		clock.Advance(time.Minute)
+		for i := 0; i < runs; i++ {
+			<-ended
+		}
+	}
+	clock.BlockUntil(1)
+	s.DeleteTask("up")
+	s.Stop()
+
+	minute := func(n int) time.Time { return start.Add(time.Duration(n) * time.Minute) }
+	got := make(map[string][]string)
+	for done := false; !done; {
+		select {
+		case e := <-s.Events():
+			desc := e.Kind.String()
+			if !e.Planned.IsZero() {
+				desc += " " + e.Planned.Sub(start).String()
+			}
+			switch e.Kind {
+			case EventSkip:
+				desc += " " + e.Reason
+			case EventFailure:
+				desc += " " + e.Err.Error()
+			}
+			got[e.Task] = append(got[e.Task], desc)
+		default:
+			done = true
+		}
+	}
+	for _, descs := range got {
+		sort.Strings(descs)
+	}
+	equal(t, map[string][]string{
+		"up": {
+			"failure 2m0s boom",
+			"removed",
+			"scheduled 1m0s",
+			"scheduled 2m0s",
+			"scheduled 3m0s",
+			"start 1m0s",
+			"start 2m0s",
+			"success 1m0s",
+		},
+		"down": {
+			"skip 2m0s upstream up failed: boom",
+			"start 1m0s",
+			"success 1m0s",
+		},
+	}, got)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(failures) != 1 {
+		t.Fatalf("OnFailure called %d times; want 1", len(failures))
+	}
+	if e := failures[0]; e.Task != "up" || !e.Planned.Equal(minute(2)) || !e.Time.Equal(minute(2)) || e.Err == nil {
+		t.Errorf("OnFailure got %+v", e)
+	}
+}
+
+var benchSpecs = []string{
+	"* * * * * *",
+	"0 0 0 * * *",
+	"0 0 0 29 2 *",
+	"0 30 9 ? * 2#2",
+	"0 0 0 LW * ?",
+	"CRON_TZ=America/New_York 0 30 2 * * *",
+}
+
+func BenchmarkScheduleNext(b *testing.B) {
+	from := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, spec := range benchSpecs {
+		sched := MustParseSchedule(spec)
+		b.Run(spec, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				sched.Next(from)
+			}
+		})
+	}
+}
+
+func BenchmarkSchedulePrev(b *testing.B) {
+	from := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, spec := range benchSpecs {
+		sched := MustParseSchedule(spec)
+		b.Run(spec, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				sched.Prev(from)
+			}
+		})
+	}
+}